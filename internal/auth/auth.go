@@ -0,0 +1,295 @@
+// auth - api key 认证, 每个 key 可以单独配置权限、有效期、请求频率以及每日任务配额
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/haojie06/midjourney-http/internal/logger"
+)
+
+const (
+	QuotaImagine  = "imagine" // imagine 以及 variation、reroll、outpaint、blend 等会生成新四宫格的任务
+	QuotaUpscale  = "upscale"
+	QuotaDescribe = "describe"
+
+	// scope 与配额类型同名, admin 可以管理 key 以及 bot
+	ScopeImagine  = QuotaImagine
+	ScopeUpscale  = QuotaUpscale
+	ScopeDescribe = QuotaDescribe
+	ScopeAdmin    = "admin"
+
+	ContextKey = "api_key" // 认证通过后, *APIKey 保存在 gin.Context 中的 key
+)
+
+var (
+	KeyManagerApp *KeyManager
+
+	ErrQuotaExceeded   = fmt.Errorf("daily quota exceeded")
+	ErrKeyNameRequired = fmt.Errorf("key name is required")
+	ErrKeyNameExists   = fmt.Errorf("key name already exists")
+	ErrKeyExists       = fmt.Errorf("key already exists")
+	ErrKeyNotFound     = fmt.Errorf("key not found")
+	ErrInvalidScope    = fmt.Errorf("invalid scope")
+	ErrAdminScopeMixed = fmt.Errorf("admin scope cannot be combined with other scopes")
+	ErrInvalidExpiry   = fmt.Errorf("invalid expiry, should be RFC3339 or 2006-01-02")
+
+	// 没有配置 scopes 时的默认权限, 不包括 admin
+	defaultScopes = []string{ScopeImagine, ScopeUpscale, ScopeDescribe}
+)
+
+func init() {
+	KeyManagerApp, _ = NewKeyManager("", "", nil, "", "")
+}
+
+type KeyConfig struct {
+	Name string `mapstructure:"name"`
+
+	Key string `mapstructure:"key" json:"-"` // 明文, 加载时转换为哈希, 建议使用 keyHash
+
+	KeyHash string `mapstructure:"keyHash" json:"key_hash"` // sha256 hex
+
+	Scopes []string `mapstructure:"scopes" json:"scopes"` // imagine、upscale、describe 或者单独的 admin, 为空时为除 admin 外的全部权限
+
+	ExpiresAt string `mapstructure:"expiresAt" json:"expires_at"` // RFC3339 或 2006-01-02, 为空表示不过期
+
+	RequestsPerMinute int `mapstructure:"requestsPerMinute" json:"requests_per_minute"` // 0 表示不限制
+
+	DailyQuotas map[string]int `mapstructure:"dailyQuotas" json:"daily_quotas"` // imagine、upscale、describe 每日任务数量, 未配置的类型不限制
+}
+
+// 对外展示的 key 信息, 不包含 key 本身
+type KeyInfo struct {
+	Name string `json:"name"`
+
+	Scopes []string `json:"scopes"`
+
+	ExpiresAt *time.Time `json:"expires_at"`
+
+	Expired bool `json:"expired"`
+
+	Source string `json:"source"` // config 或 runtime(通过接口添加)
+
+	RequestsPerMinute int `json:"requests_per_minute"`
+
+	DailyQuotas map[string]int `json:"daily_quotas"`
+}
+
+type KeyUsage struct {
+	Name string `json:"name"`
+
+	RequestsPerMinute int `json:"requests_per_minute"`
+
+	Date string `json:"date"` // UTC 日期, 每日配额在 UTC 零点重置
+
+	Used map[string]int `json:"used"`
+
+	Quotas map[string]int `json:"quotas"`
+}
+
+type APIKey struct {
+	config KeyConfig
+
+	scopes map[string]bool
+
+	expiresAt *time.Time
+
+	runtime bool // 通过接口添加, 需要持久化
+
+	tokens float64 // 令牌桶, 容量为每分钟请求数
+
+	lastRefill time.Time
+
+	usageDate string
+
+	used map[string]int
+
+	usageStore *usageStore // 为 nil 时配额只记录在内存中
+
+	lock sync.Mutex
+}
+
+func newAPIKey(config KeyConfig) (*APIKey, error) {
+	if config.DailyQuotas == nil {
+		config.DailyQuotas = make(map[string]int)
+	}
+	if config.KeyHash == "" {
+		config.KeyHash = HashKey(config.Key)
+	}
+	config.Key = ""
+	if len(config.Scopes) == 0 {
+		config.Scopes = defaultScopes
+	}
+	scopes := make(map[string]bool, len(config.Scopes))
+	for _, scope := range config.Scopes {
+		if scope != ScopeImagine && scope != ScopeUpscale && scope != ScopeDescribe && scope != ScopeAdmin {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+		}
+		scopes[scope] = true
+	}
+	// 管理用的 key 与调用任务接口的 key 分开, 任务接口的 key 泄露时不会影响 bot 与 key 的管理
+	if scopes[ScopeAdmin] && len(scopes) > 1 {
+		return nil, ErrAdminScopeMixed
+	}
+	expiresAt, err := parseExpiry(config.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &APIKey{
+		config:     config,
+		scopes:     scopes,
+		expiresAt:  expiresAt,
+		tokens:     float64(config.RequestsPerMinute),
+		lastRefill: time.Now(),
+		used:       make(map[string]int),
+	}, nil
+}
+
+func parseExpiry(expiresAt string) (*time.Time, error) {
+	if expiresAt == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, expiresAt); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, ErrInvalidExpiry
+}
+
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (k *APIKey) Name() string {
+	return k.config.Name
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	return k.scopes[scope]
+}
+
+func (k *APIKey) Expired() bool {
+	return k.expiresAt != nil && time.Now().After(*k.expiresAt)
+}
+
+func (k *APIKey) Info() KeyInfo {
+	info := KeyInfo{
+		Name:              k.config.Name,
+		Scopes:            k.config.Scopes,
+		ExpiresAt:         k.expiresAt,
+		Expired:           k.Expired(),
+		Source:            "config",
+		RequestsPerMinute: k.config.RequestsPerMinute,
+		DailyQuotas:       k.config.DailyQuotas,
+	}
+	if k.runtime {
+		info.Source = "runtime"
+	}
+	return info
+}
+
+// 消耗一次请求, 超过频率限制时返回需要等待的时间
+func (k *APIKey) Allow() (allowed bool, retryAfter time.Duration) {
+	if k.config.RequestsPerMinute <= 0 {
+		return true, 0
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	now := time.Now()
+	ratePerSecond := float64(k.config.RequestsPerMinute) / 60
+	k.tokens = math.Min(float64(k.config.RequestsPerMinute), k.tokens+now.Sub(k.lastRefill).Seconds()*ratePerSecond)
+	k.lastRefill = now
+	if k.tokens < 1 {
+		return false, time.Duration((1 - k.tokens) / ratePerSecond * float64(time.Second))
+	}
+	k.tokens--
+	return true, 0
+}
+
+// 预占一次任务配额, 任务没有创建成功时需要调用 Refund
+func (k *APIKey) Reserve(quotaType string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.resetIfNewDay()
+	if quota, limited := k.config.DailyQuotas[quotaType]; limited && k.used[quotaType] >= quota {
+		return ErrQuotaExceeded
+	}
+	k.used[quotaType]++
+	k.saveUsage()
+	return nil
+}
+
+func (k *APIKey) Refund(quotaType string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.resetIfNewDay()
+	if k.used[quotaType] > 0 {
+		k.used[quotaType]--
+		k.saveUsage()
+	}
+}
+
+func (k *APIKey) Usage() KeyUsage {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.resetIfNewDay()
+	usage := KeyUsage{
+		Name:              k.config.Name,
+		RequestsPerMinute: k.config.RequestsPerMinute,
+		Date:              k.usageDate,
+		Used:              make(map[string]int),
+		Quotas:            make(map[string]int),
+	}
+	for _, quotaType := range []string{QuotaImagine, QuotaUpscale, QuotaDescribe} {
+		usage.Used[quotaType] = k.used[quotaType]
+	}
+	for quotaType, quota := range k.config.DailyQuotas {
+		usage.Quotas[quotaType] = quota
+	}
+	return usage
+}
+
+// 恢复当天已使用的配额, 在 key 加入 KeyManager 时调用
+func (k *APIKey) loadUsage() {
+	if k.usageStore == nil {
+		return
+	}
+	state, exist, err := k.usageStore.load(k.config.KeyHash)
+	if err != nil {
+		logger.Warnf("failed to load usage of api key %s: %s", k.config.Name, err)
+		return
+	}
+	if !exist || state.Used == nil {
+		return
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.usageDate = state.Date
+	k.used = state.Used
+	k.resetIfNewDay()
+}
+
+// 调用时需持有 lock, 保存失败只记录日志, 不影响请求
+func (k *APIKey) saveUsage() {
+	if k.usageStore == nil {
+		return
+	}
+	if err := k.usageStore.save(k.config.KeyHash, keyUsageState{Date: k.usageDate, Used: k.used}); err != nil {
+		logger.Warnf("failed to save usage of api key %s: %s", k.config.Name, err)
+	}
+}
+
+// 调用时需持有 lock
+func (k *APIKey) resetIfNewDay() {
+	today := time.Now().UTC().Format("2006-01-02")
+	if k.usageDate != today {
+		k.usageDate = today
+		k.used = make(map[string]int)
+	}
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyAllow(t *testing.T) {
+	tests := []struct {
+		name              string
+		requestsPerMinute int
+		requests          int
+		wantAllowed       int
+	}{
+		{"unlimited", 0, 100, 100},
+		{"burst up to the limit", 5, 8, 5},
+		{"single request", 1, 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiKey, err := newAPIKey(KeyConfig{Name: "test", Key: "key", RequestsPerMinute: tt.requestsPerMinute})
+			if err != nil {
+				t.Fatal(err)
+			}
+			allowed := 0
+			var lastRetryAfter time.Duration
+			for i := 0; i < tt.requests; i++ {
+				ok, retryAfter := apiKey.Allow()
+				if ok {
+					allowed++
+				}
+				lastRetryAfter = retryAfter
+			}
+			if allowed != tt.wantAllowed {
+				t.Errorf("allowed %d requests, want %d", allowed, tt.wantAllowed)
+			}
+			if allowed < tt.requests && lastRetryAfter <= 0 {
+				t.Errorf("retryAfter = %s, want a positive duration", lastRetryAfter)
+			}
+		})
+	}
+}
+
+func TestAPIKeyReserve(t *testing.T) {
+	tests := []struct {
+		name      string
+		quotas    map[string]int
+		quotaType string
+		reserves  int
+		refunds   int
+		wantUsed  int
+		wantErr   error
+	}{
+		{"unlimited type", map[string]int{QuotaUpscale: 1}, QuotaImagine, 3, 0, 3, nil},
+		{"within quota", map[string]int{QuotaImagine: 2}, QuotaImagine, 2, 0, 2, nil},
+		{"over quota", map[string]int{QuotaImagine: 2}, QuotaImagine, 3, 0, 2, ErrQuotaExceeded},
+		{"refund frees quota", map[string]int{QuotaImagine: 2}, QuotaImagine, 2, 1, 1, nil},
+		{"refund never goes negative", map[string]int{QuotaImagine: 2}, QuotaImagine, 0, 2, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiKey, err := newAPIKey(KeyConfig{Name: "test", Key: "key", DailyQuotas: tt.quotas})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var lastErr error
+			for i := 0; i < tt.reserves; i++ {
+				lastErr = apiKey.Reserve(tt.quotaType)
+			}
+			if !errors.Is(lastErr, tt.wantErr) {
+				t.Errorf("Reserve() error = %v, want %v", lastErr, tt.wantErr)
+			}
+			for i := 0; i < tt.refunds; i++ {
+				apiKey.Refund(tt.quotaType)
+			}
+			if used := apiKey.Usage().Used[tt.quotaType]; used != tt.wantUsed {
+				t.Errorf("used = %d, want %d", used, tt.wantUsed)
+			}
+		})
+	}
+}
+
+func TestKeyManagerKeepsUsageAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	configs := []KeyConfig{{Name: "bob", Key: "bob-key", DailyQuotas: map[string]int{QuotaImagine: 2}}}
+	manager, err := NewKeyManager("", "", configs, filepath.Join(dir, "keys.json"), filepath.Join(dir, "usage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey, _ := manager.Authenticate("bob-key")
+	if err = apiKey.Reserve(QuotaImagine); err != nil {
+		t.Fatal(err)
+	}
+	if err = manager.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err = NewKeyManager("", "", configs, filepath.Join(dir, "keys.json"), filepath.Join(dir, "usage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	apiKey, _ = manager.Authenticate("bob-key")
+	if used := apiKey.Usage().Used[QuotaImagine]; used != 1 {
+		t.Errorf("used after restart = %d, want 1", used)
+	}
+	if err = apiKey.Reserve(QuotaImagine); err != nil {
+		t.Fatal(err)
+	}
+	if err = apiKey.Reserve(QuotaImagine); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Reserve() error = %v, want %v", err, ErrQuotaExceeded)
+	}
+}
@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// 管理所有 api key, 以哈希为索引, 不保存明文
+type KeyManager struct {
+	keys map[string]*APIKey
+
+	lock sync.RWMutex
+
+	store *keyStore // 为 nil 时通过接口添加、吊销的 key 只保存在内存中
+
+	usageStore *usageStore
+}
+
+// legacyKey 为原来的 server.apiKey, 没有配置 apiKeys 时作为默认 key, 此时为空表示不需要认证;
+// 默认 key 只有 imagine、upscale、describe 权限, 管理接口需要 adminKey 或者单独配置的 admin key
+// storePath 保存通过接口添加以及吊销的 key, 重启后仍然生效; usageStorePath 保存每日配额的使用量
+func NewKeyManager(legacyKey, adminKey string, configs []KeyConfig, storePath, usageStorePath string) (*KeyManager, error) {
+	manager := &KeyManager{
+		keys: make(map[string]*APIKey),
+	}
+	if usageStorePath != "" {
+		usageStore, err := newUsageStore(usageStorePath)
+		if err != nil {
+			return nil, err
+		}
+		manager.usageStore = usageStore
+	}
+	if legacyKey != "" || len(configs) == 0 {
+		configs = append([]KeyConfig{{
+			Name:   "default",
+			Key:    legacyKey,
+			Scopes: defaultScopes,
+		}}, configs...)
+	}
+	if adminKey != "" {
+		// 与其他 key 相同时加载失败
+		configs = append(configs, KeyConfig{
+			Name:   "admin",
+			Key:    adminKey,
+			Scopes: []string{ScopeAdmin},
+		})
+	}
+	for i, config := range configs {
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("key-%d", i+1)
+		}
+		if err := manager.add(config, false); err != nil {
+			manager.Close()
+			return nil, fmt.Errorf("failed to load api key %s: %w", config.Name, err)
+		}
+	}
+	if storePath == "" {
+		return manager, nil
+	}
+	manager.store = &keyStore{path: storePath}
+	state, err := manager.store.load()
+	if err != nil {
+		manager.Close()
+		return nil, err
+	}
+	for _, name := range state.Revoked {
+		manager.remove(name)
+	}
+	for _, config := range state.Keys {
+		if err := manager.add(config, true); err != nil {
+			manager.Close()
+			return nil, fmt.Errorf("failed to load api key %s: %w", config.Name, err)
+		}
+	}
+	return manager, nil
+}
+
+// 关闭配额存储, 退出前调用
+func (m *KeyManager) Close() error {
+	if m.usageStore == nil {
+		return nil
+	}
+	return m.usageStore.close()
+}
+
+// 调用时需持有 lock, 或者在初始化时调用
+func (m *KeyManager) add(config KeyConfig, runtime bool) error {
+	if m.find(config.Name) != nil {
+		return ErrKeyNameExists
+	}
+	apiKey, err := newAPIKey(config)
+	if err != nil {
+		return err
+	}
+	if _, exist := m.keys[apiKey.config.KeyHash]; exist {
+		return ErrKeyExists
+	}
+	apiKey.runtime = runtime
+	apiKey.usageStore = m.usageStore
+	apiKey.loadUsage()
+	m.keys[apiKey.config.KeyHash] = apiKey
+	return nil
+}
+
+func (m *KeyManager) remove(name string) *APIKey {
+	apiKey := m.find(name)
+	if apiKey != nil {
+		delete(m.keys, apiKey.config.KeyHash)
+	}
+	return apiKey
+}
+
+func (m *KeyManager) find(name string) *APIKey {
+	for _, apiKey := range m.keys {
+		if apiKey.config.Name == name {
+			return apiKey
+		}
+	}
+	return nil
+}
+
+// 过期的 key 视为无效
+func (m *KeyManager) Authenticate(key string) (apiKey *APIKey, ok bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	apiKey, ok = m.keys[HashKey(key)]
+	if ok && apiKey.Expired() {
+		return nil, false
+	}
+	return
+}
+
+// 添加 key, config.Key 为空时随机生成, 明文只在此时返回一次
+func (m *KeyManager) AddKey(config KeyConfig) (key string, info KeyInfo, err error) {
+	if config.Name == "" {
+		err = ErrKeyNameRequired
+		return
+	}
+	key = config.Key
+	if key == "" && config.KeyHash == "" {
+		if key, err = generateKey(); err != nil {
+			return
+		}
+		config.Key = key
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err = m.add(config, true); err != nil {
+		key = ""
+		return
+	}
+	if err = m.persist(); err != nil {
+		m.remove(config.Name)
+		key = ""
+		return
+	}
+	info = m.find(config.Name).Info()
+	return
+}
+
+// 吊销 key, 配置文件中的 key 也可以吊销, 吊销记录会持久化
+func (m *KeyManager) RevokeKey(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	apiKey := m.remove(name)
+	if apiKey == nil {
+		return ErrKeyNotFound
+	}
+	if m.store != nil && !apiKey.runtime {
+		// 通过接口添加的 key 直接从存储中删除即可
+		m.store.revoke(name)
+	}
+	return m.persist()
+}
+
+func (m *KeyManager) ListKeys() []KeyInfo {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	infos := make([]KeyInfo, 0, len(m.keys))
+	for _, apiKey := range m.keys {
+		infos = append(infos, apiKey.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+func (m *KeyManager) Usage() []KeyUsage {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	usages := make([]KeyUsage, 0, len(m.keys))
+	for _, apiKey := range m.keys {
+		usages = append(usages, apiKey.Usage())
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Name < usages[j].Name
+	})
+	return usages
+}
+
+// 调用时需持有 lock
+func (m *KeyManager) persist() error {
+	if m.store == nil {
+		return nil
+	}
+	keys := make([]KeyConfig, 0)
+	for _, apiKey := range m.keys {
+		if apiKey.runtime {
+			keys = append(keys, apiKey.config)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+	return m.store.save(keys)
+}
+
+func generateKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "mjh-" + base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+type keyStoreState struct {
+	Keys []KeyConfig `json:"keys"` // 通过接口添加的 key, 只保存哈希
+
+	Revoked []string `json:"revoked"` // 被吊销的配置文件中的 key
+}
+
+// 以 json 文件保存运行时对 key 的修改
+type keyStore struct {
+	path string
+
+	revoked []string
+}
+
+func (s *keyStore) load() (state keyStoreState, err error) {
+	content, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(content, &state); err != nil {
+		return
+	}
+	s.revoked = state.Revoked
+	return
+}
+
+func (s *keyStore) revoke(name string) {
+	for _, revoked := range s.revoked {
+		if revoked == name {
+			return
+		}
+	}
+	s.revoked = append(s.revoked, name)
+}
+
+// 先写入临时文件再重命名, 避免写入中途退出导致文件损坏
+func (s *keyStore) save(keys []KeyConfig) error {
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	content, err := json.MarshalIndent(keyStoreState{Keys: keys, Revoked: s.revoked}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err = os.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
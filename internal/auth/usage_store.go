@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var usageBucket = []byte("usage")
+
+type keyUsageState struct {
+	Date string `json:"date"`
+
+	Used map[string]int `json:"used"`
+}
+
+// 以 bbolt 保存每个 key 当天已使用的配额, 以 key 的哈希为索引, 重启后配额不会被重置
+type usageStore struct {
+	db *bolt.DB
+}
+
+func newUsageStore(path string) (*usageStore, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usageBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &usageStore{db: db}, nil
+}
+
+func (s *usageStore) load(keyHash string) (state keyUsageState, exist bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(usageBucket).Get([]byte(keyHash))
+		if value == nil {
+			return nil
+		}
+		exist = true
+		return json.Unmarshal(value, &state)
+	})
+	return
+}
+
+func (s *usageStore) save(keyHash string, state keyUsageState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usageBucket).Put([]byte(keyHash), value)
+	})
+}
+
+func (s *usageStore) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,125 @@
+package discordmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 超过并发上限时返回, 可以通过 errors.Is(err, ErrTooManyTasks) 判断
+type AdmissionError struct {
+	QueueDepth int // 当前排队中的任务数量
+
+	RetryAfter time.Duration // 预计多久之后可以重试
+}
+
+func (e *AdmissionError) Error() string {
+	return fmt.Sprintf("%s, queue depth: %d, retry after: %s", ErrTooManyTasks.Error(), e.QueueDepth, e.RetryAfter)
+}
+
+func (e *AdmissionError) Unwrap() error {
+	return ErrTooManyTasks
+}
+
+// 每个 midjourney 账号同时只能执行少量任务, 超出的任务在本地排队, 队列满时拒绝新任务
+type AdmissionController struct {
+	maxInFlightTasks int // 全局同时执行的任务数量, 0 表示不限制
+
+	maxQueuedTasks int // 全局排队的任务数量, 0 表示不限制
+
+	bots func() []*DiscordBot
+
+	registry *TaskRegistry
+
+	admitLock sync.Mutex // 检查名额与写入 runtime 之间持有, 并发提交时不会超出上限
+}
+
+// 统计 bot 上执行中与排队中的任务数量
+func (bot *DiscordBot) TaskCounts() (running, queued int) {
+	bot.runtimesLock.RLock()
+	defer bot.runtimesLock.RUnlock()
+	for _, taskRuntime := range bot.taskRuntimes {
+		if !taskRuntime.InFlight() {
+			continue
+		}
+		if taskRuntime.State == TaskStateQueued {
+			queued++
+		} else {
+			running++
+		}
+	}
+	return
+}
+
+func (a *AdmissionController) globalTaskCounts() (running, queued int) {
+	for _, bot := range a.bots() {
+		botRunning, botQueued := bot.TaskCounts()
+		running += botRunning
+		queued += botQueued
+	}
+	return
+}
+
+// 全局排队中的任务数量
+func (a *AdmissionController) QueueDepth() int {
+	_, queued := a.globalTaskCounts()
+	return queued
+}
+
+// 判断 bot 是否还能接收新任务, 执行中的任务达到上限后, 新任务进入排队, 排队也满时拒绝;
+// 允许时返回 release, 调用方写入 runtime 之后再调用, 期间其他任务的检查需要等待
+func (a *AdmissionController) Admit(bot *DiscordBot) (release func(), err error) {
+	a.admitLock.Lock()
+	defer func() {
+		if err != nil {
+			a.admitLock.Unlock()
+		}
+	}()
+	config := bot.Config()
+	running, queued := bot.TaskCounts()
+	if isFull(running, queued, config.MaxInFlightTasks, config.MaxQueuedTasks) {
+		err = &AdmissionError{
+			QueueDepth: queued,
+			RetryAfter: a.estimateRetryAfter(queued, config.MaxInFlightTasks),
+		}
+		return
+	}
+	globalRunning, globalQueued := a.globalTaskCounts()
+	if isFull(globalRunning, globalQueued, a.maxInFlightTasks, a.maxQueuedTasks) {
+		err = &AdmissionError{
+			QueueDepth: globalQueued,
+			RetryAfter: a.estimateRetryAfter(globalQueued, a.maxInFlightTasks),
+		}
+		return
+	}
+	return a.admitLock.Unlock, nil
+}
+
+// 执行中的任务是否还没有达到上限, 由 bot 的 worker 在发送请求前调用
+func (a *AdmissionController) HasSlot(bot *DiscordBot) bool {
+	running, _ := bot.TaskCounts()
+	if maxInFlight := bot.Config().MaxInFlightTasks; maxInFlight > 0 && running >= maxInFlight {
+		return false
+	}
+	if a.maxInFlightTasks > 0 {
+		globalRunning, _ := a.globalTaskCounts()
+		return globalRunning < a.maxInFlightTasks
+	}
+	return true
+}
+
+func isFull(running, queued, maxInFlight, maxQueued int) bool {
+	if maxInFlight <= 0 {
+		return false
+	}
+	return running+queued >= maxInFlight+maxQueued
+}
+
+// 根据最近任务的平均耗时, 估算排在前面的任务执行完所需的时间
+func (a *AdmissionController) estimateRetryAfter(queued, maxInFlight int) time.Duration {
+	if maxInFlight <= 0 {
+		maxInFlight = 1
+	}
+	rounds := queued/maxInFlight + 1
+	return time.Duration(rounds) * a.registry.AverageTaskDuration()
+}
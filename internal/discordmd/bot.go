@@ -1,8 +1,9 @@
 package discordmd
 
 import (
-	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
@@ -10,16 +11,20 @@ import (
 	"github.com/haojie06/midjourney-http/internal/logger"
 )
 
+const defaultMaxConcurrentCommands = 3
+
 type DiscordBot struct {
 	UniqueId string
 
 	BotId string
 
-	config DiscordBotConfig
+	config DiscordBotConfig // 重新加载配置时会被替换, 通过 Config() 读取
+
+	configLock sync.RWMutex
 
 	discordSession *discordgo.Session
 
-	taskChan chan *MidjourneyTask
+	taskQueue *TaskQueue
 
 	taskRuntimes map[string]*TaskRuntime
 
@@ -29,19 +34,58 @@ type DiscordBot struct {
 
 	runtimesLock sync.RWMutex
 
-	randGenerator *rand.Rand
+	pendingInteractions map[string]*pendingInteraction // nonce -> 等待 interaction id 的指令
+
+	unmatchedMessages []*discordgo.MessageCreate // 指令等待 interaction id 期间, 无法匹配到任务的消息
+
+	pendingInteractionsLock sync.Mutex // 同时保护 pendingInteractions 与 unmatchedMessages
+
+	runningCommands atomic.Int32 // 正在执行的任务处理函数数量
+
+	commandDone chan struct{}
+
+	accountInfo *AccountInfo
+
+	accountInfoLock sync.RWMutex
+
+	currentSettings *BotSettings
+
+	settingsLock sync.RWMutex
+
+	jobMode JobMode // 账号当前的模式, 为空表示未知
+
+	jobModeLock sync.RWMutex
 
-	interactionResponseMutex *sync.RWMutex
+	jobModeSwitchLock sync.RWMutex // 切换模式时独占, 提交 imagine 时共享
 
-	interactionResponseCond *sync.Cond
+	fastHoursExhausted atomic.Bool // fast 时长已经用完, fast 与 turbo 任务退回 relax
 
-	slashCommandResponse SlashCommandResponse
+	admission *AdmissionController
+
+	health *botHealthTracker
+
+	taskTimeout time.Duration // 任务等待结果的最长时间, 超时后失败并释放执行名额, 0 表示不限制
+
+	retired atomic.Bool // 已被移除或替换, 不再接收新任务, 任务结束后关闭
+
+	disabled atomic.Bool // 通过接口禁用, 不再接收任何任务, 包括已有任务的 upscale
+
+	maintenance atomic.Bool // 维护模式, 不再接收新任务, 已有任务的 upscale 等操作不受影响
+
+	fromConfig bool // 来自配置文件, 只有这些 bot 会在配置变化时被调整
+
+	closed chan struct{}
+
+	closeOnce sync.Once
 
 	logger *logger.CustomLogger
 }
 
 func NewDiscordBot(config DiscordBotConfig) (*DiscordBot, error) {
 	logger.Infof("creating discord bot, uniqueId: %s", config.UniqueId)
+	if _, err := ParseJobMode(config.DefaultJobMode); err != nil {
+		return nil, err
+	}
 	ds, err := discordgo.New(config.DiscordToken)
 	if err != nil {
 		return nil, err
@@ -50,30 +94,31 @@ func NewDiscordBot(config DiscordBotConfig) (*DiscordBot, error) {
 	if err != nil {
 		return nil, err
 	}
-	interactionResposneMutex := sync.RWMutex{}
 	bot := &DiscordBot{
-		config:                   config,
-		UniqueId:                 config.UniqueId,
-		BotId:                    uuid.New().String(),
-		discordSession:           ds,
-		taskChan:                 make(chan *MidjourneyTask, 1),
-		taskRuntimes:             make(map[string]*TaskRuntime),
-		FileHeaders:              sync.Map{},
-		discordCommands:          make(map[string]*discordgo.ApplicationCommand),
-		runtimesLock:             sync.RWMutex{},
-		randGenerator:            rand.New(rand.NewSource(time.Now().UnixNano())),
-		interactionResponseMutex: &interactionResposneMutex,
-		interactionResponseCond:  sync.NewCond(&interactionResposneMutex),
-		logger:                   logger.NewCustomLogger().With("uniqueId", config.UniqueId),
+		config:              config,
+		UniqueId:            config.UniqueId,
+		BotId:               uuid.New().String(),
+		discordSession:      ds,
+		taskQueue:           NewTaskQueue(),
+		closed:              make(chan struct{}),
+		taskRuntimes:        make(map[string]*TaskRuntime),
+		FileHeaders:         sync.Map{},
+		discordCommands:     make(map[string]*discordgo.ApplicationCommand),
+		runtimesLock:        sync.RWMutex{},
+		pendingInteractions: make(map[string]*pendingInteraction),
+		commandDone:         make(chan struct{}, 1),
+		logger:              logger.NewCustomLogger().With("uniqueId", config.UniqueId),
 	}
+	bot.health = newBotHealthTracker(bot.logger.Warnf)
 	for _, command := range commands {
 		bot.discordCommands[command.Name] = command
 	}
-	bot.discordSession.AddHandler(bot.onDiscordMessageWithEmbedsCreate)
-	bot.discordSession.AddHandler(bot.onDiscordMessageWithAttachmentsCreate)
-
+	// MESSAGE_CREATE 的处理函数由 onInteractionNonceEvent 在记录 interaction id 之后调用, 见 messageCreateHandlers
 	bot.discordSession.AddHandler(bot.onDiscordMessageUpdate)
-	bot.discordSession.AddHandler(bot.onMessageWithInteractionCreate)
+	bot.discordSession.AddHandler(bot.onInteractionNonceEvent)
+	bot.discordSession.AddHandler(bot.onGatewayConnect)
+	bot.discordSession.AddHandler(bot.onGatewayResumed)
+	bot.discordSession.AddHandler(bot.onGatewayDisconnect)
 	bot.discordSession.Identify.Intents = discordgo.IntentsAll
 	if err := bot.discordSession.Open(); err != nil {
 		return nil, err
@@ -82,21 +127,203 @@ func NewDiscordBot(config DiscordBotConfig) (*DiscordBot, error) {
 }
 
 // task worker loop
-// 接收任务，并向discord发送请求
+// 接收任务，并向discord发送请求, 每个任务在单独的 goroutine 中处理, 等待 interaction id 时不阻塞后续任务
 func (bot *DiscordBot) Start() {
 	for {
-		task := <-bot.taskChan
-		bot.logger.Infof("receive %s task: %s", task.TaskType, task.TaskId)
-		switch task.TaskType {
-		case MidjourneyTaskTypeImageGeneration:
-			bot.ImagineTaskHandler(task.TaskId, task.Payload)
-		case MidjourneyTaskTypeImageUpscale:
-			bot.UpscaleTaskHandler(task.TaskId, task.Payload)
-		case MidjourneyTaskTypeImageDescribe:
-			bot.DescribeTaskHandler(task.TaskId, task.Payload)
+		var task *MidjourneyTask
+		if bot.hasCommandSlot() {
+			// 执行名额已满时只取出不占用名额的任务, 例如 upscale
+			task = bot.taskQueue.PopFirst(func(task *MidjourneyTask) bool {
+				return bot.admission == nil || !task.TaskType.consumesJobSlot() || bot.admission.HasSlot(bot)
+			})
+		}
+		if task == nil {
+			select {
+			case <-bot.taskQueue.Notify():
+			case <-bot.commandDone:
+			case <-time.After(time.Second):
+			case <-bot.closed:
+				bot.logger.Infof("task worker stopped")
+				return
+			}
+			continue
+		}
+		bot.logger.Infof("receive %s task: %s, priority: %d, waited: %s", task.TaskType, task.TaskId, task.Priority, time.Since(task.EnqueuedAt))
+		if task.TaskType.consumesJobSlot() {
+			// 在取出下一个任务之前占用执行名额
+			bot.markTaskRunning(task.TaskId)
+		}
+		bot.runningCommands.Add(1)
+		go bot.handleTask(task)
+	}
+}
+
+func (bot *DiscordBot) handleTask(task *MidjourneyTask) {
+	defer func() {
+		bot.runningCommands.Add(-1)
+		select {
+		case bot.commandDone <- struct{}{}:
 		default:
-			bot.logger.Warnf("found unknown task type: %s", task.TaskType)
 		}
+	}()
+	switch task.TaskType {
+	case MidjourneyTaskTypeImageGeneration:
+		bot.ImagineTaskHandler(task.TaskId, task.Payload)
+	case MidjourneyTaskTypeImageUpscale:
+		bot.UpscaleTaskHandler(task.TaskId, task.Payload)
+	case MidjourneyTaskTypeImageDescribe:
+		bot.DescribeTaskHandler(task.TaskId, task.Payload)
+	case MidjourneyTaskTypeImageVariation:
+		bot.VariationTaskHandler(task.TaskId, task.Payload)
+	case MidjourneyTaskTypeImageReroll:
+		bot.RerollTaskHandler(task.TaskId, task.Payload)
+	case MidjourneyTaskTypeImageOutpaint:
+		bot.OutpaintTaskHandler(task.TaskId, task.Payload)
+	case MidjourneyTaskTypeImageBlend:
+		bot.BlendTaskHandler(task.TaskId, task.Payload)
+	case MidjourneyTaskTypePromptShorten:
+		bot.ShortenTaskHandler(task.TaskId, task.Payload)
+	case MidjourneyTaskTypeAccountInfo:
+		bot.AccountInfoTaskHandler(task.TaskId, task.Payload)
+	case MidjourneyTaskTypeBotSettings:
+		bot.SettingsTaskHandler(task.TaskId, task.Payload)
+	default:
+		bot.logger.Warnf("found unknown task type: %s", task.TaskType)
+	}
+}
+
+// 同时处理的任务数量不超过 maxConcurrentCommands
+func (bot *DiscordBot) hasCommandSlot() bool {
+	limit := bot.Config().MaxConcurrentCommands
+	if limit <= 0 {
+		limit = defaultMaxConcurrentCommands
+	}
+	return int(bot.runningCommands.Load()) < limit
+}
+
+// 取出后即视为执行中, 请求还没有发出时也占用执行名额
+func (bot *DiscordBot) markTaskRunning(taskId string) {
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	if taskRuntime, exist := bot.taskRuntimes[taskId]; exist && taskRuntime.State == TaskStateQueued {
+		taskRuntime.SetState(TaskStateRunning)
+	}
+}
+
+// 停止 worker 并断开 gateway, 还在队列中以及没有结果的任务直接返回失败
+func (bot *DiscordBot) Close() {
+	bot.closeOnce.Do(func() {
+		close(bot.closed)
+		if err := bot.discordSession.Close(); err != nil {
+			bot.logger.Warnf("failed to close discord session, err: %s", err)
+		}
+		bot.failRemainingTasks()
+	})
+}
+
+// 连接关闭后不会再收到结果, 包括排队中的 manual upscale
+func (bot *DiscordBot) failRemainingTasks() {
+	for bot.taskQueue.PopFirst(func(*MidjourneyTask) bool { return true }) != nil {
+	}
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	for taskId, taskRuntime := range bot.taskRuntimes {
+		if !taskRuntime.InFlight() && taskRuntime.State != TaskStateManualUpscaling {
+			continue
+		}
+		bot.logger.Warnf("task %s is failed because the bot is closed, state: %s", taskId, taskRuntime.State)
+		taskRuntime.pendingUpscaleIndexes = nil
+		taskRuntime.Response(false, ErrBotClosed.Error(), nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.FileHeaders.Delete(taskId)
+	}
+}
+
+func (bot *DiscordBot) Retired() bool {
+	return bot.retired.Load()
+}
+
+func (bot *DiscordBot) Enabled() bool {
+	return !bot.disabled.Load()
+}
+
+func (bot *DiscordBot) InMaintenance() bool {
+	return bot.maintenance.Load()
+}
+
+// 还没有返回结果的任务 id, 按创建时间排序
+func (bot *DiscordBot) InFlightTaskIds() []string {
+	bot.runtimesLock.RLock()
+	runtimes := make([]*TaskRuntime, 0, len(bot.taskRuntimes))
+	for _, taskRuntime := range bot.taskRuntimes {
+		if taskRuntime.InFlight() {
+			runtimes = append(runtimes, taskRuntime)
+		}
+	}
+	bot.runtimesLock.RUnlock()
+	sort.Slice(runtimes, func(i, j int) bool {
+		return runtimes[i].CreatedAt.Before(runtimes[j].CreatedAt)
+	})
+	taskIds := make([]string, 0, len(runtimes))
+	for _, taskRuntime := range runtimes {
+		taskIds = append(taskIds, taskRuntime.TaskId)
+	}
+	return taskIds
+}
+
+// 没有执行中以及排队中的任务
+func (bot *DiscordBot) Idle() bool {
+	running, queued := bot.TaskCounts()
+	return running == 0 && queued == 0 && bot.taskQueue.Len() == 0
+}
+
+// 正在执行的任务数量, 用于调度
+func (bot *DiscordBot) InFlightTasks() (count int) {
+	bot.runtimesLock.RLock()
+	defer bot.runtimesLock.RUnlock()
+	for _, taskRuntime := range bot.taskRuntimes {
+		if taskRuntime.InFlight() {
+			count++
+		}
+	}
+	return
+}
+
+func (bot *DiscordBot) Config() DiscordBotConfig {
+	bot.configLock.RLock()
+	defer bot.configLock.RUnlock()
+	return bot.config
+}
+
+// 调度权重, 未配置时为 1
+func (bot *DiscordBot) Weight() int {
+	if weight := bot.Config().Weight; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// 丢失结果的任务(例如消息被删除、gateway 断开期间完成)一直占用执行名额, 超时后返回失败并移除
+func (bot *DiscordBot) failExpiredTasks() {
+	if bot.taskTimeout <= 0 {
+		return
+	}
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	for taskId, taskRuntime := range bot.taskRuntimes {
+		if !taskRuntime.Expired(bot.taskTimeout) {
+			continue
+		}
+		bot.logger.Warnf("task %s timeout after %s, state: %s", taskId, bot.taskTimeout, taskRuntime.State)
+		taskRuntime.pendingUpscaleIndexes = nil
+		if taskRuntime.responded {
+			// manual upscale 超时, 原图仍然可以继续使用
+			taskRuntime.Response(false, "upscale timeout", nil)
+			continue
+		}
+		taskRuntime.Response(false, "task timeout", nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.FileHeaders.Delete(taskId)
 	}
 }
 
@@ -114,6 +341,28 @@ func (bot *DiscordBot) getTaskRuntimeByOriginMessageId(messageId string) *TaskRu
 	return nil
 }
 
+// 查找还在等待新图片的子任务, 同一消息上有多个子任务时按创建顺序匹配
+func (bot *DiscordBot) getPendingTaskRuntimeBySourceMessageId(messageId string) (pending *TaskRuntime) {
+	for _, taskRuntime := range bot.taskRuntimes {
+		if taskRuntime.SourceMessageId != messageId || taskRuntime.OriginImageMessageId != "" {
+			continue
+		}
+		if pending == nil || taskRuntime.CreatedAt.Before(pending.CreatedAt) {
+			pending = taskRuntime
+		}
+	}
+	return
+}
+
+func (bot *DiscordBot) getTaskRuntimeByResponseMessageId(messageId string) *TaskRuntime {
+	for _, taskRuntime := range bot.taskRuntimes {
+		if taskRuntime.ResponseMessageId == messageId {
+			return taskRuntime
+		}
+	}
+	return nil
+}
+
 func (bot *DiscordBot) getTaskRuntimeByInteractionId(interactionId string) *TaskRuntime {
 	if interactionId == "" {
 		return nil
@@ -126,6 +375,22 @@ func (bot *DiscordBot) getTaskRuntimeByInteractionId(interactionId string) *Task
 	return nil
 }
 
+// 子任务与父任务的 prompt 相同, 收到新图片时优先匹配还没有拿到图片的任务
+func (bot *DiscordBot) getPendingTaskRuntimeByTaskKeywordHash(taskKeywordHash string) (pending *TaskRuntime) {
+	if taskKeywordHash == "" {
+		return nil
+	}
+	for _, taskRuntime := range bot.taskRuntimes {
+		if taskRuntime.TaskKeywordHash != taskKeywordHash || taskRuntime.OriginImageMessageId != "" {
+			continue
+		}
+		if pending == nil || taskRuntime.CreatedAt.Before(pending.CreatedAt) {
+			pending = taskRuntime
+		}
+	}
+	return
+}
+
 func (bot *DiscordBot) getTaskRuntimeByTaskKeywordHash(taskKeywordHash string) *TaskRuntime {
 	if taskKeywordHash == "" {
 		return nil
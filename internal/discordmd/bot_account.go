@@ -0,0 +1,77 @@
+package discordmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// 返回缓存的账号信息, 没有缓存时 exist 为 false
+func (bot *DiscordBot) GetAccountInfo() (info AccountInfo, exist bool) {
+	bot.accountInfoLock.RLock()
+	defer bot.accountInfoLock.RUnlock()
+	if bot.accountInfo == nil {
+		return
+	}
+	return *bot.accountInfo, true
+}
+
+func (bot *DiscordBot) setAccountInfo(info AccountInfo) {
+	bot.accountInfoLock.Lock()
+	bot.accountInfo = &info
+	bot.accountInfoLock.Unlock()
+	if mode, err := ParseJobMode(info.JobMode); err == nil && mode != "" {
+		bot.setJobMode(mode)
+	}
+	bot.updateFastHours(info)
+}
+
+func (bot *DiscordBot) AccountInfoTaskHandler(taskId string, payload json.RawMessage) {
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	taskRuntime, exist := bot.taskRuntimes[taskId]
+	if !exist {
+		bot.logger.Errorf("cannot find task runtime for task: %s", taskId)
+		return
+	}
+	bot.runtimesLock.Unlock()
+	interactionId, status, err := bot.info(taskId)
+	bot.runtimesLock.Lock()
+	if taskRuntime.responded {
+		return
+	}
+	if err != nil {
+		eMessage := fmt.Sprintf("task %s failed to request, error occured: %s", taskId, err.Error())
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Errorf(eMessage)
+		return
+	}
+	if status >= 400 {
+		eMessage := fmt.Sprintf("task %s failed to request, status code: %d", taskId, status)
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Warnf(eMessage)
+		return
+	}
+	taskRuntime.InteractionId = interactionId
+	taskRuntime.SetRunning()
+}
+
+// /info 的结果为 embed 消息
+func (bot *DiscordBot) onAccountInfoMessage(taskRuntime *TaskRuntime, message *discordgo.Message) {
+	for _, embed := range message.Embeds {
+		info := parseAccountInfo(embed.Description)
+		if info.Subscription == "" && info.JobMode == "" {
+			continue
+		}
+		info.UpdatedAt = time.Now()
+		bot.setAccountInfo(info)
+		bot.logger.Infof("account info updated, job mode: %s, fast time remaining: %s", info.JobMode, info.FastTimeRemaining)
+		taskRuntime.Response(true, "", info)
+		bot.RemoveTaskRuntime(taskRuntime.TaskId)
+		return
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"time"
 
@@ -16,9 +17,16 @@ type DiscordCommand string
 const (
 	DiscordCommandFast     DiscordCommand = "fast"
 	DiscordCommandRelax    DiscordCommand = "relax"
+	DiscordCommandTurbo    DiscordCommand = "turbo"
 	DiscordCommandImagine  DiscordCommand = "imagine"
 	DiscordCommandUpscale  DiscordCommand = "upscale"
 	DiscordCommandDescribe DiscordCommand = "describe"
+	DiscordCommandBlend    DiscordCommand = "blend"
+	DiscordCommandShorten  DiscordCommand = "shorten"
+	DiscordCommandInfo     DiscordCommand = "info"
+	DiscordCommandSettings DiscordCommand = "settings"
+
+	DiscordCommandCustomZoom DiscordCommand = "custom_zoom" // 不是 slash command, 点击按钮后等待弹窗时用于区分
 )
 
 func (bot *DiscordBot) sendInteractionRequest(payload []byte) (status int, err error) {
@@ -27,76 +35,78 @@ func (bot *DiscordBot) sendInteractionRequest(payload []byte) (status int, err e
 		return 500, err
 	}
 	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Authorization", bot.config.DiscordToken)
+	request.Header.Set("Authorization", bot.Config().DiscordToken)
 
 	resposne, err := http.DefaultClient.Do(request)
 	if err != nil {
+		bot.health.recordFailure("interaction request failed: " + err.Error())
 		return 500, err
 	}
 	defer resposne.Body.Close()
+	if resposne.StatusCode >= 400 {
+		bot.health.recordFailure(fmt.Sprintf("interaction request failed, status code: %d", resposne.StatusCode))
+	} else {
+		bot.health.recordSuccess()
+	}
 	return resposne.StatusCode, nil
 }
-func checkCommandResponse(commandType DiscordCommand, slashCommandResponse SlashCommandResponse) bool {
-	return slashCommandResponse.Name == string(commandType)
-}
 
 // 部分指令(目前除了upscale)，在发送执行请求后，需要阻塞等待，拿到interactionId
-func (bot *DiscordBot) executeSlashCommand(commandType DiscordCommand, commandPayload []byte) (interactionId string, status int, err error) {
-	// 通过 sync.cond 拿到执行结果
+// 每个请求带有唯一的 nonce, gateway 返回相同 nonce 的事件时取回 interaction id, 同一个 bot 可以同时等待多个指令
+func (bot *DiscordBot) executeSlashCommand(commandType DiscordCommand, taskId, nonce string, commandPayload []byte) (interactionId string, status int, err error) {
+	// 先登记再发送, 避免响应先于登记到达
+	pending := bot.addPendingInteraction(nonce, commandType, taskId)
+	defer bot.removePendingInteraction(nonce)
 	status, err = bot.sendInteractionRequest(commandPayload)
-	if err != nil {
+	if err != nil || status >= 400 {
 		return "", status, err
 	}
-	sigChan := make(chan struct{})
 	// 防止部分指令在发送后，没有收到响应，导致一直阻塞
-	timoutChan := time.After(3 * time.Minute)
-	go func() {
-		bot.interactionResponseMutex.Lock()
-		// 直到收到对应的响应
-		for !checkCommandResponse(commandType, bot.slashCommandResponse) {
-			bot.interactionResponseCond.Wait()
-		}
-		interactionId = bot.slashCommandResponse.InteractionId
-		// 移除命令，因为一个响应只对应一个请求
-		// bot.slashCommandResponse = SlashCommandResponse{}
-		bot.interactionResponseMutex.Unlock()
-		time.Sleep(time.Duration((bot.randGenerator.Intn(1000))+1000) * time.Millisecond)
-		sigChan <- struct{}{}
-	}()
 	select {
-	case <-sigChan:
+	case result := <-pending.result:
+		if result.failed {
+			status = 400
+			bot.health.recordFailure(fmt.Sprintf("%s command failed", commandType))
+			return
+		}
+		interactionId = result.interactionId
+		time.Sleep(randomCommandDelay())
 		return
-	case <-timoutChan:
+	case <-time.After(3 * time.Minute):
 		status = 408
+		bot.health.recordFailure(fmt.Sprintf("no response for %s command", commandType))
 		return
+	case <-bot.closed:
+		return "", 500, ErrBotClosed
 	}
 }
 
 // MessageComponent交互 包括 upscale variant等，不需要等待响应拿到id
 func (bot *DiscordBot) executeMessageComponent(commandPayload []byte) (status int, err error) {
 	status, err = bot.sendInteractionRequest(commandPayload)
-	time.Sleep(time.Duration((bot.randGenerator.Intn(1000))+1000) * time.Millisecond)
+	time.Sleep(randomCommandDelay())
 	return
 }
 
-func (bot *DiscordBot) buildModeSwitchPayload(fast bool) (commandPayload []byte, err error) {
-	var commnad *discordgo.ApplicationCommand
-	var exists bool
-	if fast {
-		commnad, exists = bot.discordCommands["fast"]
-	} else {
-		commnad, exists = bot.discordCommands["relax"]
-	}
+// 指令之间随机间隔 1-2 秒
+func randomCommandDelay() time.Duration {
+	return time.Duration(rand.Intn(1000)+1000) * time.Millisecond
+}
+
+// fast、relax、turbo、info、settings 等没有参数的指令
+func (bot *DiscordBot) buildNoOptionCommandPayload(commandType DiscordCommand, nonce string) (commandPayload []byte, err error) {
+	commnad, exists := bot.discordCommands[string(commandType)]
 	if !exists || commnad == nil {
 		err = ErrCommandNotFound
 		return
 	}
+	config := bot.Config()
 	payload := InteractionRequest{
 		Type:          2,
 		ApplicationID: commnad.ApplicationID,
-		ChannelID:     bot.config.DiscordChannelId,
-		SessionID:     bot.config.DiscordSessionId,
-		GuildID:       bot.config.DiscordGuildId,
+		ChannelID:     config.DiscordChannelId,
+		SessionID:     config.DiscordSessionId,
+		GuildID:       config.DiscordGuildId,
 		Data: InteractionRequestData{
 			Version:            commnad.Version,
 			ID:                 commnad.ID,
@@ -106,12 +116,13 @@ func (bot *DiscordBot) buildModeSwitchPayload(fast bool) (commandPayload []byte,
 			ApplicationCommand: commnad,
 			Attachments:        []interface{}{},
 		},
+		Nonce: nonce,
 	}
 	commandPayload, err = json.Marshal(payload)
 	return
 }
 
-func (bot *DiscordBot) buildImaginePayload(taskId string, prompt string) (commandPayload []byte, err error) {
+func (bot *DiscordBot) buildImaginePayload(prompt, nonce string) (commandPayload []byte, err error) {
 	imagineCommand, exists := bot.discordCommands["imagine"]
 	if !exists {
 		err = ErrCommandNotFound
@@ -123,12 +134,13 @@ func (bot *DiscordBot) buildImaginePayload(taskId string, prompt string) (comman
 		Name:  "prompt",
 		Value: prompt,
 	})
+	config := bot.Config()
 	payload := InteractionRequest{
 		Type:          2,
 		ApplicationID: imagineCommand.ApplicationID,
-		ChannelID:     bot.config.DiscordChannelId,
-		SessionID:     bot.config.DiscordSessionId,
-		GuildID:       bot.config.DiscordGuildId,
+		ChannelID:     config.DiscordChannelId,
+		SessionID:     config.DiscordSessionId,
+		GuildID:       config.DiscordGuildId,
 		Data: InteractionRequestData{
 			Version:            imagineCommand.Version,
 			ID:                 imagineCommand.ID,
@@ -138,6 +150,41 @@ func (bot *DiscordBot) buildImaginePayload(taskId string, prompt string) (comman
 			ApplicationCommand: imagineCommand,
 			Attachments:        []interface{}{},
 		},
+		Nonce: nonce,
+	}
+	commandPayload, err = json.Marshal(payload)
+	return
+}
+
+func (bot *DiscordBot) buildShortenPayload(prompt, nonce string) (commandPayload []byte, err error) {
+	shortenCommand, exists := bot.discordCommands["shorten"]
+	if !exists {
+		err = ErrCommandNotFound
+		return
+	}
+	var dataOptions []*discordgo.ApplicationCommandInteractionDataOption
+	dataOptions = append(dataOptions, &discordgo.ApplicationCommandInteractionDataOption{
+		Type:  3,
+		Name:  "prompt",
+		Value: prompt,
+	})
+	config := bot.Config()
+	payload := InteractionRequest{
+		Type:          2,
+		ApplicationID: shortenCommand.ApplicationID,
+		ChannelID:     config.DiscordChannelId,
+		SessionID:     config.DiscordSessionId,
+		GuildID:       config.DiscordGuildId,
+		Data: InteractionRequestData{
+			Version:            shortenCommand.Version,
+			ID:                 shortenCommand.ID,
+			Name:               shortenCommand.Name,
+			Type:               int(shortenCommand.Type),
+			Options:            dataOptions,
+			ApplicationCommand: shortenCommand,
+			Attachments:        []interface{}{},
+		},
+		Nonce: nonce,
 	}
 	commandPayload, err = json.Marshal(payload)
 	return
@@ -145,24 +192,72 @@ func (bot *DiscordBot) buildImaginePayload(taskId string, prompt string) (comman
 
 // different from slash command interaction
 func (bot *DiscordBot) buildUpscalePayload(id, index, messageId string) (commandPayload []byte, err error) {
+	return bot.buildMessageComponentPayload(fmt.Sprintf("MJ::JOB::upsample::%s::%s", index, id), messageId)
+}
+
+func (bot *DiscordBot) buildVariationPayload(id, index, messageId string) (commandPayload []byte, err error) {
+	return bot.buildMessageComponentPayload(fmt.Sprintf("MJ::JOB::variation::%s::%s", index, id), messageId)
+}
+
+func (bot *DiscordBot) buildRerollPayload(id, messageId string) (commandPayload []byte, err error) {
+	return bot.buildMessageComponentPayload(fmt.Sprintf("MJ::JOB::reroll::0::%s::SOLO", id), messageId)
+}
+
+// zoom out、make square 以及 pan 都是 upscale 结果消息上的按钮, id 为 upscale 后图片的 id
+func (bot *DiscordBot) buildOutpaintPayload(id string, action OutpaintAction, messageId string) (commandPayload []byte, err error) {
+	var customId string
+	switch action {
+	case OutpaintActionZoomOut2x:
+		customId = fmt.Sprintf("MJ::Outpaint::50::1::%s::SOLO", id)
+	case OutpaintActionZoomOut1_5x:
+		customId = fmt.Sprintf("MJ::Outpaint::75::1::%s::SOLO", id)
+	case OutpaintActionMakeSquare:
+		customId = fmt.Sprintf("MJ::Outpaint::100::1::%s::SOLO", id)
+	case OutpaintActionPanLeft, OutpaintActionPanRight, OutpaintActionPanUp, OutpaintActionPanDown:
+		customId = fmt.Sprintf("MJ::JOB::%s::1::%s::SOLO", action, id)
+	default:
+		err = ErrInvalidOutpaintAction
+		return
+	}
+	return bot.buildMessageComponentPayload(customId, messageId)
+}
+
+// 点击消息上的按钮, customId 即按钮的 custom_id
+func (bot *DiscordBot) buildMessageComponentPayload(customId, messageId string) (commandPayload []byte, err error) {
+	return bot.buildComponentInteractionPayload(messageId, 0, UpSampleData{
+		ComponentType: 2,
+		CustomID:      customId,
+	})
+}
+
+// 选择菜单, 例如 /settings 中的模型版本
+func (bot *DiscordBot) buildSelectMenuPayload(customId, messageId string, messageFlags int, values []string) (commandPayload []byte, err error) {
+	return bot.buildComponentInteractionPayload(messageId, messageFlags, SelectMenuData{
+		ComponentType: 3,
+		CustomID:      customId,
+		Type:          3,
+		Values:        values,
+	})
+}
+
+// 仅自己可见(ephemeral)的消息, 交互时需要带上消息的 flags
+func (bot *DiscordBot) buildComponentInteractionPayload(messageId string, messageFlags int, data interface{}) (commandPayload []byte, err error) {
+	config := bot.Config()
 	payload := InteractionRequestTypeThree{
 		Type:          3,
-		MessageFlags:  0,
+		MessageFlags:  messageFlags,
 		MessageID:     messageId,
-		ApplicationID: bot.config.DiscordAppId,
-		ChannelID:     bot.config.DiscordChannelId,
-		GuildID:       bot.config.DiscordGuildId,
-		SessionID:     bot.config.DiscordSessionId,
-		Data: UpSampleData{
-			ComponentType: 2,
-			CustomID:      fmt.Sprintf("MJ::JOB::upsample::%s::%s", index, id),
-		},
+		ApplicationID: config.DiscordAppId,
+		ChannelID:     config.DiscordChannelId,
+		GuildID:       config.DiscordGuildId,
+		SessionID:     config.DiscordSessionId,
+		Data:          data,
 	}
 	commandPayload, err = json.Marshal(payload)
 	return
 }
 
-func (bot *DiscordBot) describeRequest(filename, uploadFilename string) (commandPayload []byte, err error) {
+func (bot *DiscordBot) describeRequest(filename, uploadFilename, nonce string) (commandPayload []byte, err error) {
 	describeCommand, exists := bot.discordCommands["describe"]
 	if !exists {
 		err = ErrCommandNotFound
@@ -175,12 +270,13 @@ func (bot *DiscordBot) describeRequest(filename, uploadFilename string) (command
 		Name:  "image",
 		Value: 0,
 	})
+	config := bot.Config()
 	payload := InteractionRequest{
 		Type:          2,
 		ApplicationID: describeCommand.ApplicationID,
-		ChannelID:     bot.config.DiscordChannelId,
-		GuildID:       bot.config.DiscordGuildId,
-		SessionID:     bot.config.DiscordSessionId,
+		ChannelID:     config.DiscordChannelId,
+		GuildID:       config.DiscordGuildId,
+		SessionID:     config.DiscordSessionId,
 		Data: InteractionRequestData{
 			Version:            describeCommand.Version,
 			ID:                 describeCommand.ID,
@@ -194,41 +290,128 @@ func (bot *DiscordBot) describeRequest(filename, uploadFilename string) (command
 				UploadedFilename: uploadFilename,
 			}},
 		},
+		Nonce: nonce,
 	}
 	commandPayload, err = json.Marshal(payload)
 
 	return
 }
 
+// blend 的图片选项依次为 image1 ~ image5, 引用上传后的 attachment
+func (bot *DiscordBot) blendRequest(attachments []AttachmentInCommand, dimensions, nonce string) (commandPayload []byte, err error) {
+	blendCommand, exists := bot.discordCommands["blend"]
+	if !exists {
+		err = ErrCommandNotFound
+		return
+	}
+
+	var dataOptions []*discordgo.ApplicationCommandInteractionDataOption
+	commandAttachments := make([]interface{}, 0, len(attachments))
+	for i, attachment := range attachments {
+		dataOptions = append(dataOptions, &discordgo.ApplicationCommandInteractionDataOption{
+			Type:  11,
+			Name:  fmt.Sprintf("image%d", i+1),
+			Value: i,
+		})
+		commandAttachments = append(commandAttachments, attachment)
+	}
+	if dimensions != "" {
+		dataOptions = append(dataOptions, &discordgo.ApplicationCommandInteractionDataOption{
+			Type:  3,
+			Name:  "dimensions",
+			Value: dimensions,
+		})
+	}
+	config := bot.Config()
+	payload := InteractionRequest{
+		Type:          2,
+		ApplicationID: blendCommand.ApplicationID,
+		ChannelID:     config.DiscordChannelId,
+		GuildID:       config.DiscordGuildId,
+		SessionID:     config.DiscordSessionId,
+		Data: InteractionRequestData{
+			Version:            blendCommand.Version,
+			ID:                 blendCommand.ID,
+			Name:               blendCommand.Name,
+			Type:               int(blendCommand.Type),
+			Options:            dataOptions,
+			ApplicationCommand: blendCommand,
+			Attachments:        commandAttachments,
+		},
+		Nonce: nonce,
+	}
+	commandPayload, err = json.Marshal(payload)
+	return
+}
+
 // 调用 discord /v9/interaction 接口, 执行 slash command 或者是 message component 点击等交互
-func (bot *DiscordBot) switchFastMode(fast bool) (interactionId string, status int, err error) {
-	commandPayload, err := bot.buildModeSwitchPayload(fast)
+func (bot *DiscordBot) switchJobMode(mode JobMode) (interactionId string, status int, err error) {
+	nonce := newNonce()
+	commandPayload, err := bot.buildNoOptionCommandPayload(mode.command(), nonce)
 	if err != nil {
 		return "", 500, err
 	}
-	c := DiscordCommandFast
-	if !fast {
-		c = DiscordCommandRelax
+	interactionId, status, err = bot.executeSlashCommand(mode.command(), "", nonce, commandPayload)
+	return
+}
+
+func (bot *DiscordBot) info(taskId string) (interactionId string, status int, err error) {
+	nonce := newNonce()
+	commandPayload, err := bot.buildNoOptionCommandPayload(DiscordCommandInfo, nonce)
+	if err != nil {
+		return "", 500, err
+	}
+	interactionId, status, err = bot.executeSlashCommand(DiscordCommandInfo, taskId, nonce, commandPayload)
+	return
+}
+
+func (bot *DiscordBot) settings(taskId string) (interactionId string, status int, err error) {
+	nonce := newNonce()
+	commandPayload, err := bot.buildNoOptionCommandPayload(DiscordCommandSettings, nonce)
+	if err != nil {
+		return "", 500, err
 	}
-	interactionId, status, err = bot.executeSlashCommand(c, commandPayload)
+	interactionId, status, err = bot.executeSlashCommand(DiscordCommandSettings, taskId, nonce, commandPayload)
 	return
 }
 
 func (bot *DiscordBot) imagine(taskId, prompt string) (interactionId string, status int, err error) {
-	commandPayload, err := bot.buildImaginePayload(taskId, prompt)
+	nonce := newNonce()
+	commandPayload, err := bot.buildImaginePayload(prompt, nonce)
 	if err != nil {
 		return "", 500, err
 	}
-	interactionId, status, err = bot.executeSlashCommand(DiscordCommandImagine, commandPayload)
+	interactionId, status, err = bot.executeSlashCommand(DiscordCommandImagine, taskId, nonce, commandPayload)
 	return
 }
 
-func (bot *DiscordBot) describe(filename, uploadFilename string) (interactionId string, status int, err error) {
-	commandPayload, err := bot.describeRequest(filename, uploadFilename)
+func (bot *DiscordBot) shorten(taskId, prompt string) (interactionId string, status int, err error) {
+	nonce := newNonce()
+	commandPayload, err := bot.buildShortenPayload(prompt, nonce)
 	if err != nil {
 		return "", 500, err
 	}
-	interactionId, status, err = bot.executeSlashCommand(DiscordCommandDescribe, commandPayload)
+	interactionId, status, err = bot.executeSlashCommand(DiscordCommandShorten, taskId, nonce, commandPayload)
+	return
+}
+
+func (bot *DiscordBot) describe(taskId, filename, uploadFilename string) (interactionId string, status int, err error) {
+	nonce := newNonce()
+	commandPayload, err := bot.describeRequest(filename, uploadFilename, nonce)
+	if err != nil {
+		return "", 500, err
+	}
+	interactionId, status, err = bot.executeSlashCommand(DiscordCommandDescribe, taskId, nonce, commandPayload)
+	return
+}
+
+func (bot *DiscordBot) blend(taskId string, attachments []AttachmentInCommand, dimensions string) (interactionId string, status int, err error) {
+	nonce := newNonce()
+	commandPayload, err := bot.blendRequest(attachments, dimensions, nonce)
+	if err != nil {
+		return "", 500, err
+	}
+	interactionId, status, err = bot.executeSlashCommand(DiscordCommandBlend, taskId, nonce, commandPayload)
 	return
 }
 
@@ -241,3 +424,108 @@ func (bot *DiscordBot) upscale(originImageId, index, messageId string) (status i
 	status, err = bot.executeMessageComponent(commandPayload)
 	return
 }
+
+func (bot *DiscordBot) variation(originImageId, index, messageId string) (status int, err error) {
+	commandPayload, err := bot.buildVariationPayload(originImageId, index, messageId)
+	if err != nil {
+		return 500, err
+	}
+	status, err = bot.executeMessageComponent(commandPayload)
+	return
+}
+
+func (bot *DiscordBot) reroll(originImageId, messageId string) (status int, err error) {
+	commandPayload, err := bot.buildRerollPayload(originImageId, messageId)
+	if err != nil {
+		return 500, err
+	}
+	status, err = bot.executeMessageComponent(commandPayload)
+	return
+}
+
+// custom zoom 先点击按钮, midjourney 返回填写 prompt 的弹窗, 在 prompt 末尾指定 --zoom 后提交
+func (bot *DiscordBot) customZoom(upscaledImageId, messageId string, zoom float64, prompt string) (status int, err error) {
+	nonce := newNonce()
+	pending := bot.addPendingInteraction(nonce, DiscordCommandCustomZoom, "")
+	defer bot.removePendingInteraction(nonce)
+	config := bot.Config()
+	commandPayload, err := json.Marshal(InteractionRequestTypeThree{
+		Type:          3,
+		MessageID:     messageId,
+		ApplicationID: config.DiscordAppId,
+		ChannelID:     config.DiscordChannelId,
+		GuildID:       config.DiscordGuildId,
+		SessionID:     config.DiscordSessionId,
+		Data: UpSampleData{
+			ComponentType: 2,
+			CustomID:      fmt.Sprintf("MJ::CustomZoom::%s", upscaledImageId),
+		},
+		Nonce: nonce,
+	})
+	if err != nil {
+		return 500, err
+	}
+	if status, err = bot.sendInteractionRequest(commandPayload); err != nil || status >= 400 {
+		return
+	}
+	var modal *interactionModal
+	select {
+	case result := <-pending.result:
+		modal = result.modal
+	case <-time.After(time.Minute):
+	case <-bot.closed:
+		return 500, ErrBotClosed
+	}
+	if modal == nil {
+		bot.health.recordFailure("no modal for custom zoom")
+		return 408, ErrModalNotReceived
+	}
+	commandPayload, err = bot.buildCustomZoomSubmitPayload(modal, zoom, prompt)
+	if err != nil {
+		return 500, err
+	}
+	time.Sleep(randomCommandDelay())
+	return bot.executeMessageComponent(commandPayload)
+}
+
+// 弹窗中只有一个 prompt 输入框, 预先填写了原来的 prompt, 替换其中的 --zoom
+func (bot *DiscordBot) buildCustomZoomSubmitPayload(modal *interactionModal, zoom float64, prompt string) (commandPayload []byte, err error) {
+	components := modal.Components
+	for i := range components {
+		for j := range components[i].Components {
+			input := &components[i].Components[j]
+			if input.Type != 4 {
+				continue
+			}
+			if prompt == "" {
+				prompt = input.Value
+			}
+			input.Value = setZoomParam(prompt, zoom)
+		}
+	}
+	config := bot.Config()
+	payload := ModalSubmitRequest{
+		Type:          5,
+		ApplicationID: config.DiscordAppId,
+		ChannelID:     config.DiscordChannelId,
+		GuildID:       config.DiscordGuildId,
+		SessionID:     config.DiscordSessionId,
+		Data: ModalSubmitData{
+			ID:         modal.Id,
+			CustomID:   modal.CustomId,
+			Components: components,
+		},
+		Nonce: newNonce(),
+	}
+	commandPayload, err = json.Marshal(payload)
+	return
+}
+
+func (bot *DiscordBot) outpaint(upscaledImageId string, action OutpaintAction, messageId string) (status int, err error) {
+	commandPayload, err := bot.buildOutpaintPayload(upscaledImageId, action, messageId)
+	if err != nil {
+		return 500, err
+	}
+	status, err = bot.executeMessageComponent(commandPayload)
+	return
+}
@@ -4,12 +4,13 @@ package discordmd
 import (
 	"runtime"
 	"strconv"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
 func (bot *DiscordBot) onDiscordMessageWithEmbedsCreate(s *discordgo.Session, event *discordgo.MessageCreate) {
-	if bot.config.DiscordChannelId != "" && event.ChannelID != bot.config.DiscordChannelId {
+	if bot.Config().DiscordChannelId != "" && event.ChannelID != bot.Config().DiscordChannelId {
 		return
 	}
 	// warn or error message are embeded messages with title and description
@@ -39,8 +40,29 @@ func (bot *DiscordBot) onDiscordMessageWithEmbedsCreate(s *discordgo.Session, ev
 			return
 		}
 		bot.logger.Warnf("task %s failed, reason: %s descripiton: %s", taskRuntime.TaskId, embed.Title, embed.Description)
+		// 频道中可能有其他账号的消息, 只有自己的任务触发时才隔离
+		if _, restricted := QuarantineEmbededMessageTitles[embed.Title]; restricted {
+			bot.health.quarantine(embed.Title)
+		}
+		if _, exhausted := FastHoursExhaustedEmbededMessageTitles[embed.Title]; exhausted {
+			bot.fastHoursExhausted.Store(true)
+			if bot.retryInRelaxMode(taskRuntime) {
+				return
+			}
+		}
 		taskRuntime.Response(false, embed.Title+"\n"+embed.Description, nil)
 		bot.RemoveTaskRuntime(taskRuntime.TaskId)
+	} else if event.Interaction != nil && event.Interaction.Name == string(DiscordCommandShorten) {
+		if taskRuntime := bot.getTaskRuntimeByInteractionId(event.Interaction.ID); taskRuntime != nil {
+			bot.onShortenMessage(taskRuntime, event.Message)
+		}
+	} else if event.Interaction != nil && event.Interaction.Name == string(DiscordCommandInfo) {
+		if taskRuntime := bot.getTaskRuntimeByInteractionId(event.Interaction.ID); taskRuntime != nil {
+			bot.onAccountInfoMessage(taskRuntime, event.Message)
+		}
+	} else if taskRuntime := bot.getShortenTaskRuntimeByReferencedMessage(event.ReferencedMessage); taskRuntime != nil {
+		// Show Details 的结果可能以回复的形式出现
+		bot.onShortenMessage(taskRuntime, event.Message)
 	} else {
 		bot.logger.Warnf("unknown embed title found: %s\n%s", embed.Title, embed.Description)
 	}
@@ -49,7 +71,7 @@ func (bot *DiscordBot) onDiscordMessageWithEmbedsCreate(s *discordgo.Session, ev
 // when receive message from discord(image generated, upscaled, etc.)
 // origin message or upscaled message does not have embeded message
 func (bot *DiscordBot) onDiscordMessageWithAttachmentsCreate(s *discordgo.Session, event *discordgo.MessageCreate) {
-	if bot.config.DiscordChannelId != "" && event.ChannelID != bot.config.DiscordChannelId {
+	if bot.Config().DiscordChannelId != "" && event.ChannelID != bot.Config().DiscordChannelId {
 		return
 	}
 	// warn or error message are embeded messages with title and description
@@ -66,39 +88,19 @@ func (bot *DiscordBot) onDiscordMessageWithAttachmentsCreate(s *discordgo.Sessio
 		// 原始图片没有referenced message
 		// receive origin image, send upscale request depends on config
 		taskKeywordHash, promptStr := getHashFromMessage(event.Content)
-		taskRuntime := bot.getTaskRuntimeByTaskKeywordHash(taskKeywordHash)
+		taskRuntime := bot.getPendingTaskRuntimeByTaskKeywordHash(taskKeywordHash)
 		if taskRuntime == nil {
-			bot.logger.Warnf("task with keywordHash %s is not created by this bot, prompt: %s", taskKeywordHash, promptStr)
-			return
+			// blend 的 prompt 中没有 seed, 使用开始时记录的 prompt 哈希匹配
+			taskRuntime = bot.getPendingTaskRuntimeByTaskKeywordHash(getHashFromPromptMessage(event.Content))
 		}
-		bot.logger.Infof("task: %s receives origin image: %s", taskRuntime.TaskId, attachment.URL)
-		// we will use messageId to map upscaled image to origin image
-		taskRuntime.OriginImageMessageId = event.ID
-		taskRuntime.OriginImageURL = attachment.URL
-		taskRuntime.OriginImageId = getFileIdFromURL(attachment.URL)
-		if !taskRuntime.AutoUpscale {
-			// only return origin image url, user can upscale it manually
-			taskRuntime.Response(true, "", ImageGenerationResultPayload{
-				OriginImageURL: attachment.URL,
-				ImageURLs:      []string{},
-			})
+		if taskRuntime == nil {
+			bot.logger.Warnf("task with keywordHash %s is not created by this bot, prompt: %s", taskKeywordHash, promptStr)
 			return
 		}
-
-		// when auto upscale enable
-		taskRuntime.State = TaskStateAutoUpscaling
-		for i := 1; i <= bot.config.UpscaleCount; i++ {
-			status, err := bot.upscale(taskRuntime.OriginImageId, strconv.Itoa(i), event.ID)
-			if err != nil {
-				bot.logger.Errorf("failed to upscale image, err: %s", err.Error())
-				taskRuntime.UpscaleProcessCount += 1
-			} else if status >= 400 {
-				bot.logger.Errorf("failed to upscale image, status: %d", status)
-				taskRuntime.UpscaleProcessCount += 1
-			} else {
-				bot.logger.Infof("task %s autoUpscale image %s %d", taskRuntime.TaskId, taskRuntime.OriginImageId, i)
-			}
-		}
+		bot.onOriginImageReceived(taskRuntime, event.ID, attachment.URL)
+	} else if taskRuntime := bot.getPendingTaskRuntimeBySourceMessageId(event.ReferencedMessage.ID); taskRuntime != nil && !bot.isUpscaleResult(event.ReferencedMessage.ID, event.Content) {
+		// variation 等子任务生成的新图片同样会引用原消息, 需要与 upscale 的结果区分开
+		bot.onOriginImageReceived(taskRuntime, event.ID, attachment.URL)
 	} else {
 		// upscaled 的图片有referenced message
 		// receive upscaling image, use referenced message id to map to taskId
@@ -110,27 +112,22 @@ func (bot *DiscordBot) onDiscordMessageWithAttachmentsCreate(s *discordgo.Sessio
 		}
 		bot.logger.Infof("task %s receives upscaled image: %s", taskRuntime.TaskId, attachment.URL)
 		taskRuntime.UpscaledImageURLs = append(taskRuntime.UpscaledImageURLs, attachment.URL)
+		index := taskRuntime.SetUpscaledImage(getImageIndexFromMessage(event.Content), event.ID, attachment.URL)
 		switch taskRuntime.State {
 		case TaskStateAutoUpscaling:
 			// 自动upscale时，接收到图片还需要判断是否接收到了所有图片，如果是则返回结果
 			taskRuntime.UpscaleProcessCount += 1
-			if taskRuntime.UpscaleProcessCount == bot.config.UpscaleCount {
+			if taskRuntime.UpscaleProcessCount == bot.Config().UpscaleCount {
 				bot.logger.Infof("task %s image generation is completed, current goroutine count: %d", taskRuntime.TaskId, runtime.NumGoroutine())
-				taskRuntime.taskResultChan <- TaskResult{
-					TaskId:     taskRuntime.TaskId,
-					Successful: true,
-					Payload: ImageGenerationResultPayload{
-						ImageURLs:      taskRuntime.UpscaledImageURLs,
-						OriginImageURL: taskRuntime.OriginImageURL,
-					},
-				}
+				taskRuntime.Response(true, "", ImageGenerationResultPayload{
+					ImageURLs:      taskRuntime.UpscaledImageURLs,
+					OriginImageURL: taskRuntime.OriginImageURL,
+				})
 				bot.RemoveTaskRuntime(taskRuntime.TaskId)
 			} else {
-				bot.logger.Infof("task %s image generation is not completed, waiting for images: %d/%d", taskRuntime.TaskId, len(taskRuntime.UpscaledImageURLs), bot.config.UpscaleCount)
+				bot.logger.Infof("task %s image generation is not completed, waiting for images: %d/%d", taskRuntime.TaskId, len(taskRuntime.UpscaledImageURLs), bot.Config().UpscaleCount)
 			}
 		case TaskStateManualUpscaling:
-			// get index from message
-			index := getImageIndexFromMessage(event.Content)
 			taskRuntime.Response(true, "", ImageUpscaleResultPayload{
 				ImageURL: attachment.URL,
 				Index:    index,
@@ -139,13 +136,60 @@ func (bot *DiscordBot) onDiscordMessageWithAttachmentsCreate(s *discordgo.Sessio
 	}
 }
 
+// upscale 的结果带有 Image #n, 部分版本没有时, 原任务还在等待 upscale 也视为 upscale 的结果
+func (bot *DiscordBot) isUpscaleResult(referencedMessageId, content string) bool {
+	taskRuntime := bot.getTaskRuntimeByOriginMessageId(referencedMessageId)
+	return taskRuntime != nil && (getImageIndexFromMessage(content) != "" || len(taskRuntime.pendingUpscaleIndexes) > 0)
+}
+
+// 收到任务生成的原始图片(四宫格), 根据配置返回结果或者自动 upscale
+func (bot *DiscordBot) onOriginImageReceived(taskRuntime *TaskRuntime, messageId, imageURL string) {
+	bot.logger.Infof("task: %s receives origin image: %s", taskRuntime.TaskId, imageURL)
+	// we will use messageId to map upscaled image to origin image
+	taskRuntime.SetOriginImage(messageId, imageURL)
+	if !taskRuntime.AutoUpscale {
+		// only return origin image url, user can upscale it manually
+		taskRuntime.Response(true, "", ImageGenerationResultPayload{
+			OriginImageURL: imageURL,
+			ImageURLs:      []string{},
+		})
+		return
+	}
+
+	// when auto upscale enable
+	taskRuntime.SetState(TaskStateAutoUpscaling)
+	for i := 1; i <= bot.Config().UpscaleCount; i++ {
+		status, err := bot.upscale(taskRuntime.OriginImageId, strconv.Itoa(i), messageId)
+		if err != nil {
+			bot.logger.Errorf("failed to upscale image, err: %s", err.Error())
+			taskRuntime.UpscaleProcessCount += 1
+		} else if status >= 400 {
+			bot.logger.Errorf("failed to upscale image, status: %d", status)
+			taskRuntime.UpscaleProcessCount += 1
+		} else {
+			taskRuntime.AddPendingUpscale(strconv.Itoa(i))
+			bot.logger.Infof("task %s autoUpscale image %s %d", taskRuntime.TaskId, taskRuntime.OriginImageId, i)
+		}
+	}
+}
+
 // when discord message updated (for example, when a request is intercepted by a filter)
 func (bot *DiscordBot) onDiscordMessageUpdate(s *discordgo.Session, event *discordgo.MessageUpdate) {
-	if bot.config.DiscordChannelId != "" && event.ChannelID != bot.config.DiscordChannelId {
+	if bot.Config().DiscordChannelId != "" && event.ChannelID != bot.Config().DiscordChannelId {
 		return
 	}
 	bot.runtimesLock.Lock()
 	defer bot.runtimesLock.Unlock()
+	// /settings 点击按钮后会更新原消息
+	if taskRuntime := bot.getSettingsTaskRuntime(event.Message); taskRuntime != nil {
+		bot.onSettingsMessage(taskRuntime, event.Message)
+		return
+	}
+	if len(event.Message.Embeds) == 0 {
+		// 生成过程中会不断更新消息中的进度与预览图
+		bot.onProgressMessage(event.Message)
+		return
+	}
 	for _, embed := range event.Message.Embeds {
 		if _, failed := FailedEmbededMessageTitlesInUpdate[embed.Title]; failed {
 			// 大部分失败提示都是 embeded message
@@ -170,25 +214,165 @@ func (bot *DiscordBot) onDiscordMessageUpdate(s *discordgo.Session, event *disco
 				taskRuntime.Response(true, "", ImageDescribeResultPayload{
 					Description: embed.Description,
 				})
+			case string(DiscordCommandShorten):
+				if taskRuntime := bot.getTaskRuntimeByInteractionId(event.Interaction.ID); taskRuntime != nil {
+					bot.onShortenMessage(taskRuntime, event.Message)
+				}
+				return
+			case string(DiscordCommandInfo):
+				if taskRuntime := bot.getTaskRuntimeByInteractionId(event.Interaction.ID); taskRuntime != nil {
+					bot.onAccountInfoMessage(taskRuntime, event.Message)
+				}
+				return
 			}
 		}
 	}
 }
 
-// 在发送命令后，用其取回interaction的id
-func (bot *DiscordBot) onMessageWithInteractionCreate(s *discordgo.Session, event *discordgo.MessageCreate) {
-	if bot.config.DiscordChannelId != "" && event.ChannelID != bot.config.DiscordChannelId {
+// blend 开始时的消息(Waiting to start)会引用 interaction, 记录其中的 prompt 用于匹配之后生成的图片
+func (bot *DiscordBot) onBlendStartMessageCreate(s *discordgo.Session, event *discordgo.MessageCreate) {
+	if bot.Config().DiscordChannelId != "" && event.ChannelID != bot.Config().DiscordChannelId {
+		return
+	}
+	if event.Interaction == nil || event.Interaction.Name != string(DiscordCommandBlend) {
+		return
+	}
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	taskRuntime := bot.getTaskRuntimeByInteractionId(event.Interaction.ID)
+	if taskRuntime == nil {
+		return
+	}
+	if taskKeywordHash := getHashFromPromptMessage(event.Content); taskKeywordHash != "" {
+		taskRuntime.TaskKeywordHash = taskKeywordHash
+	}
+}
+
+// 任务开始前会先发送一条 Waiting to start 的消息
+func (bot *DiscordBot) onProgressMessageCreate(s *discordgo.Session, event *discordgo.MessageCreate) {
+	if bot.Config().DiscordChannelId != "" && event.ChannelID != bot.Config().DiscordChannelId {
+		return
+	}
+	if len(event.Embeds) != 0 || len(event.Attachments) != 0 {
+		return
+	}
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	bot.onProgressMessage(event.Message)
+}
+
+// 调用时需持有 runtimesLock
+func (bot *DiscordBot) onProgressMessage(message *discordgo.Message) {
+	progress, status := parseProgressMessage(message.Content)
+	if progress < 0 && status == "" {
+		return
+	}
+	taskKeywordHash, _ := getHashFromMessage(message.Content)
+	taskRuntime := bot.getPendingTaskRuntimeByTaskKeywordHash(taskKeywordHash)
+	if taskRuntime == nil {
+		taskRuntime = bot.getPendingTaskRuntimeByTaskKeywordHash(getHashFromPromptMessage(message.Content))
+	}
+	if taskRuntime == nil && message.ReferencedMessage != nil {
+		taskRuntime = bot.getPendingTaskRuntimeBySourceMessageId(message.ReferencedMessage.ID)
+	}
+	if taskRuntime == nil {
+		return
+	}
+	previewImageURL := ""
+	if len(message.Attachments) > 0 {
+		previewImageURL = message.Attachments[0].URL
+	}
+	if progress == taskRuntime.Progress && status == taskRuntime.ProgressStatus && previewImageURL == "" {
+		return
+	}
+	bot.logger.Infof("task %s progress: %d%%, status: %s", taskRuntime.TaskId, progress, status)
+	taskRuntime.SetProgress(progress, status, previewImageURL)
+}
+
+func (bot *DiscordBot) getShortenTaskRuntimeByReferencedMessage(referencedMessage *discordgo.Message) *TaskRuntime {
+	if referencedMessage == nil {
+		return nil
+	}
+	return bot.getTaskRuntimeByResponseMessageId(referencedMessage.ID)
+}
+
+// shorten 的结果为 embed 消息, 包含重要的 token 以及精简后的 prompt, 点击 Show Details 后才能拿到每个 token 的权重
+func (bot *DiscordBot) onShortenMessage(taskRuntime *TaskRuntime, message *discordgo.Message) {
+	if taskRuntime.ResponseMessageId == "" && message.Interaction != nil {
+		taskRuntime.ResponseMessageId = message.ID
+	}
+	if taskRuntime.shortenResult == nil {
+		taskRuntime.shortenResult = &PromptShortenResultPayload{
+			Tokens:           []ShortenToken{},
+			ShortenedPrompts: []string{},
+		}
+	}
+	result := taskRuntime.shortenResult
+	weights := make(map[string]float64)
+	for _, embed := range message.Embeds {
+		tokens, options := parseShortenDescription(embed.Description)
+		if len(tokens) > 0 {
+			result.Tokens = tokens
+		}
+		if len(options) > 0 {
+			result.ShortenedPrompts = options
+		}
+		for token, weight := range parseShortenTokenWeights(embed.Description) {
+			weights[token] = weight
+		}
+		for _, field := range embed.Fields {
+			for token, weight := range parseShortenTokenWeights(field.Value) {
+				weights[token] = weight
+			}
+		}
+	}
+	if len(weights) > 0 {
+		applyShortenTokenWeights(result, weights)
+		bot.respondShortenResult(taskRuntime)
+		return
+	}
+	if len(result.Tokens) == 0 && len(result.ShortenedPrompts) == 0 {
+		// 还在处理中
 		return
 	}
-	if event.Interaction == nil {
+	if taskRuntime.shortenDetailsRequested {
 		return
 	}
-	bot.interactionResponseMutex.Lock()
-	bot.slashCommandResponse = SlashCommandResponse{
-		InteractionId: event.Interaction.ID,
-		Name:          event.Interaction.Name,
+	detailsButton := findButtonByLabel(message.Components, "Show Details")
+	if detailsButton == nil {
+		bot.respondShortenResult(taskRuntime)
+		return
+	}
+	taskRuntime.shortenDetailsRequested = true
+	commandPayload, err := bot.buildMessageComponentPayload(detailsButton.CustomID, message.ID)
+	if err != nil {
+		bot.respondShortenResult(taskRuntime)
+		return
 	}
-	bot.interactionResponseMutex.Unlock()
-	bot.interactionResponseCond.Broadcast()
+	// 调用方持有 runtimesLock, 点击在 goroutine 中进行, 不阻塞其他事件的处理
+	go func(taskId string) {
+		status, err := bot.executeMessageComponent(commandPayload)
+		requested := err == nil && status < 400
+		if requested {
+			// 一段时间内没有收到权重, 只返回已有的结果
+			time.Sleep(30 * time.Second)
+		} else {
+			bot.logger.Warnf("task %s failed to request shorten details, status: %d, err: %v", taskId, status, err)
+		}
+		bot.runtimesLock.Lock()
+		defer bot.runtimesLock.Unlock()
+		taskRuntime, exist := bot.taskRuntimes[taskId]
+		if !exist {
+			return
+		}
+		if requested {
+			bot.logger.Warnf("task %s did not receive shorten details in time", taskId)
+		}
+		bot.respondShortenResult(taskRuntime)
+	}(taskRuntime.TaskId)
+}
 
+func (bot *DiscordBot) respondShortenResult(taskRuntime *TaskRuntime) {
+	taskRuntime.Response(true, "", *taskRuntime.shortenResult)
+	bot.RemoveTaskRuntime(taskRuntime.TaskId)
 }
@@ -0,0 +1,210 @@
+package discordmd
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const discordEpoch = 1420070400000
+
+var nonceSeq atomic.Uint32
+
+// 等待 gateway 返回 interaction id 的 slash command, 以 nonce 为索引
+type pendingInteraction struct {
+	commandType DiscordCommand
+
+	taskId string // 为空表示不属于任何任务, 例如切换 fast/relax
+
+	result chan pendingInteractionResult
+}
+
+type pendingInteractionResult struct {
+	interactionId string
+
+	failed bool
+
+	modal *interactionModal // 点击按钮后弹出的窗口, 例如 custom zoom
+}
+
+// INTERACTION_MODAL_CREATE 事件, id 为提交弹窗时需要的 id
+type interactionModal struct {
+	Id string `json:"id"`
+
+	Nonce string `json:"nonce"`
+
+	CustomId string `json:"custom_id"`
+
+	Components []ModalComponent `json:"components"`
+}
+
+// 与 discord 客户端一样使用 snowflake 格式的 nonce, 低位为自增序号, 同一毫秒内也不会重复
+func newNonce() string {
+	timestamp := uint64(time.Now().UnixMilli()-discordEpoch) << 22
+	return strconv.FormatUint(timestamp|uint64(nonceSeq.Add(1)&0x3FFFFF), 10)
+}
+
+func (bot *DiscordBot) addPendingInteraction(nonce string, commandType DiscordCommand, taskId string) *pendingInteraction {
+	pending := &pendingInteraction{
+		commandType: commandType,
+		taskId:      taskId,
+		result:      make(chan pendingInteractionResult, 1),
+	}
+	bot.pendingInteractionsLock.Lock()
+	defer bot.pendingInteractionsLock.Unlock()
+	bot.pendingInteractions[nonce] = pending
+	return pending
+}
+
+func (bot *DiscordBot) removePendingInteraction(nonce string) {
+	bot.pendingInteractionsLock.Lock()
+	delete(bot.pendingInteractions, nonce)
+	var messages []*discordgo.MessageCreate
+	if len(bot.pendingInteractions) == 0 {
+		// 没有指令在等待, 暂存的消息不属于这些指令, 按原样处理
+		messages, bot.unmatchedMessages = bot.unmatchedMessages, nil
+	}
+	bot.pendingInteractionsLock.Unlock()
+	for _, message := range messages {
+		bot.dispatchMessageCreate(message)
+	}
+}
+
+// 同一个 nonce 只处理第一次, INTERACTION_CREATE、INTERACTION_SUCCESS 以及 MESSAGE_CREATE 都可能带有 nonce
+func (bot *DiscordBot) resolvePendingInteraction(nonce string, result pendingInteractionResult) {
+	bot.pendingInteractionsLock.Lock()
+	pending, exist := bot.pendingInteractions[nonce]
+	if exist && pending.commandType == DiscordCommandCustomZoom && result.modal == nil && !result.failed {
+		// 按钮本身的 interaction 先于弹窗到达, 继续等待弹窗
+		exist = false
+	} else {
+		delete(bot.pendingInteractions, nonce)
+	}
+	bot.pendingInteractionsLock.Unlock()
+	if !exist {
+		return
+	}
+	if !result.failed && pending.taskId != "" {
+		// 在返回之前记录到任务上, 避免指令的结果消息先于 InteractionId 到达
+		bot.runtimesLock.Lock()
+		if taskRuntime, exist := bot.taskRuntimes[pending.taskId]; exist {
+			taskRuntime.InteractionId = result.interactionId
+		}
+		bot.runtimesLock.Unlock()
+		bot.replayUnmatchedMessages(result.interactionId)
+	}
+	pending.result <- result
+}
+
+// 指令的结果消息可能先于 interaction id 到达, 有指令在等待时先暂存, 取回 id 后再处理
+func (bot *DiscordBot) deferUntilResolved(message *discordgo.MessageCreate) bool {
+	if message.Interaction == nil {
+		return false
+	}
+	bot.pendingInteractionsLock.Lock()
+	defer bot.pendingInteractionsLock.Unlock()
+	if len(bot.pendingInteractions) == 0 {
+		return false
+	}
+	bot.runtimesLock.RLock()
+	matched := bot.getTaskRuntimeByInteractionId(message.Interaction.ID) != nil
+	bot.runtimesLock.RUnlock()
+	if matched {
+		return false
+	}
+	bot.unmatchedMessages = append(bot.unmatchedMessages, message)
+	return true
+}
+
+func (bot *DiscordBot) replayUnmatchedMessages(interactionId string) {
+	bot.pendingInteractionsLock.Lock()
+	matched := make([]*discordgo.MessageCreate, 0)
+	remaining := bot.unmatchedMessages[:0]
+	for _, message := range bot.unmatchedMessages {
+		if message.Interaction.ID == interactionId {
+			matched = append(matched, message)
+		} else {
+			remaining = append(remaining, message)
+		}
+	}
+	bot.unmatchedMessages = remaining
+	bot.pendingInteractionsLock.Unlock()
+	for _, message := range matched {
+		bot.dispatchMessageCreate(message)
+	}
+}
+
+func (bot *DiscordBot) dispatchMessageCreate(message *discordgo.MessageCreate) {
+	for _, handler := range bot.messageCreateHandlers() {
+		go handler(bot.discordSession, message)
+	}
+}
+
+type interactionEvent struct {
+	Id string `json:"id"`
+
+	Nonce string `json:"nonce"`
+
+	ChannelId string `json:"channel_id"`
+
+	Interaction *struct {
+		Id string `json:"id"`
+	} `json:"interaction"`
+}
+
+// 通过 InteractionId 匹配任务的处理函数需要在 nonce 解析之后执行,
+// 而 discordgo 在各自的 goroutine 中调用每个处理函数, 因此不注册到 session, 由 onInteractionNonceEvent 分发
+func (bot *DiscordBot) messageCreateHandlers() []func(*discordgo.Session, *discordgo.MessageCreate) {
+	return []func(*discordgo.Session, *discordgo.MessageCreate){
+		bot.onDiscordMessageWithEmbedsCreate,
+		bot.onDiscordMessageWithAttachmentsCreate,
+		bot.onBlendStartMessageCreate,
+		bot.onSettingsMessageCreate,
+		bot.onProgressMessageCreate,
+	}
+}
+
+// 在发送命令后，用 nonce 取回 interaction 的 id, discordgo 没有解析 nonce, 因此读取原始事件
+func (bot *DiscordBot) onInteractionNonceEvent(s *discordgo.Session, event *discordgo.Event) {
+	switch event.Type {
+	case "INTERACTION_CREATE", "INTERACTION_SUCCESS", "INTERACTION_FAILURE":
+	case "MESSAGE_CREATE":
+		bot.onMessageCreateEvent(event)
+		return
+	case "INTERACTION_MODAL_CREATE":
+		var modal interactionModal
+		if err := json.Unmarshal(event.RawData, &modal); err == nil && modal.Nonce != "" {
+			bot.resolvePendingInteraction(modal.Nonce, pendingInteractionResult{interactionId: modal.Id, modal: &modal})
+		}
+		return
+	default:
+		return
+	}
+	var data interactionEvent
+	if err := json.Unmarshal(event.RawData, &data); err != nil || data.Nonce == "" {
+		return
+	}
+	switch event.Type {
+	case "INTERACTION_CREATE", "INTERACTION_SUCCESS":
+		bot.resolvePendingInteraction(data.Nonce, pendingInteractionResult{interactionId: data.Id})
+	case "INTERACTION_FAILURE":
+		bot.resolvePendingInteraction(data.Nonce, pendingInteractionResult{interactionId: data.Id, failed: true})
+	}
+}
+
+// 指令的结果消息也带有 nonce, 先记录 InteractionId, 再交给各个处理函数, 保证结果消息能匹配到任务
+func (bot *DiscordBot) onMessageCreateEvent(event *discordgo.Event) {
+	var data interactionEvent
+	if err := json.Unmarshal(event.RawData, &data); err == nil && data.Nonce != "" && data.Interaction != nil &&
+		(bot.Config().DiscordChannelId == "" || data.ChannelId == bot.Config().DiscordChannelId) {
+		bot.resolvePendingInteraction(data.Nonce, pendingInteractionResult{interactionId: data.Interaction.Id})
+	}
+	messageCreate, ok := event.Struct.(*discordgo.MessageCreate)
+	if !ok || bot.deferUntilResolved(messageCreate) {
+		return
+	}
+	bot.dispatchMessageCreate(messageCreate)
+}
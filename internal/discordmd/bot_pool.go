@@ -0,0 +1,235 @@
+package discordmd
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/haojie06/midjourney-http/internal/logger"
+)
+
+// 创建 bot 并加入调度, 连接 discord 时不持有 botMapMutex
+func (m *MidJourneyService) addBot(config DiscordBotConfig, fromConfig bool) (*DiscordBot, error) {
+	bot, err := NewDiscordBot(config)
+	if err != nil {
+		return nil, err
+	}
+	bot.fromConfig = fromConfig
+	bot.admission = m.admission
+	bot.taskTimeout = m.taskTimeout
+	if m.quarantineFailures > 0 {
+		bot.health.quarantineFailures = m.quarantineFailures
+	}
+	if m.quarantineDuration > 0 {
+		bot.health.quarantineDuration = m.quarantineDuration
+	}
+	m.botMapMutex.Lock()
+	m.discordBots[bot.BotId] = bot
+	m.botMapMutex.Unlock()
+	go bot.Start()
+	if config.Settings != nil {
+		go m.applySettingsProfile(bot, *config.Settings)
+	}
+	return bot, nil
+}
+
+// 根据新的配置调整 bot 列表, 以 uniqueId 对比:
+// 新增的 bot 直接启动, 移除的 bot 等待任务结束后关闭, 连接参数变化的 bot 启动新连接替换旧的,
+// 其余参数的变化直接生效, 未变化的 bot 不受影响
+func (m *MidJourneyService) ReloadBots(botConfigs []DiscordBotConfig) {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	current := make(map[string]*DiscordBot)
+	addedByAPI := make(map[string]bool)
+	for _, bot := range m.listBots() {
+		if bot.Retired() {
+			continue
+		}
+		if bot.fromConfig {
+			current[bot.UniqueId] = bot
+		} else {
+			addedByAPI[bot.UniqueId] = true
+		}
+	}
+	configured := make(map[string]bool, len(botConfigs))
+	for _, config := range botConfigs {
+		if configured[config.UniqueId] {
+			logger.Warnf("duplicate bot uniqueId %s in config, ignored", config.UniqueId)
+			continue
+		}
+		configured[config.UniqueId] = true
+		if m.removedBots[config.UniqueId] || addedByAPI[config.UniqueId] {
+			// 通过接口移除或添加的 bot 以接口的操作为准
+			continue
+		}
+		bot, exist := current[config.UniqueId]
+		switch {
+		case !exist:
+			logger.Infof("bot %s is added to config", config.UniqueId)
+			if _, err := m.addBot(config, true); err != nil {
+				logger.Errorf("failed to create discord bot %s, err: %s", config.UniqueId, err)
+			}
+		case connectionChanged(bot.Config(), config):
+			// 旧连接上的任务仍然可以收到结果, 新任务交给新连接
+			logger.Infof("connection of bot %s is changed, reconnecting", config.UniqueId)
+			if _, err := m.addBot(config, true); err != nil {
+				logger.Errorf("failed to reconnect discord bot %s, keep the old one, err: %s", config.UniqueId, err)
+				continue
+			}
+			m.retireBot(bot)
+		case !reflect.DeepEqual(bot.Config(), config):
+			if _, err := ParseJobMode(config.DefaultJobMode); err != nil {
+				logger.Errorf("failed to update bot %s, err: %s", config.UniqueId, err)
+				continue
+			}
+			logger.Infof("config of bot %s is updated", config.UniqueId)
+			settingsChanged := config.Settings != nil && !reflect.DeepEqual(bot.Config().Settings, config.Settings)
+			bot.updateConfig(config)
+			if settingsChanged {
+				go m.applySettingsProfile(bot, *config.Settings)
+			}
+		}
+	}
+	for uniqueId, bot := range current {
+		if !configured[uniqueId] {
+			logger.Infof("bot %s is removed from config", uniqueId)
+			m.retireBot(bot)
+		}
+	}
+	for uniqueId := range m.removedBots {
+		if !configured[uniqueId] {
+			delete(m.removedBots, uniqueId)
+		}
+	}
+}
+
+// 所有 bot 的状态与负载, 按 uniqueId 排序, 包括正在移除的 bot
+func (m *MidJourneyService) ListBotStatus() []BotStatus {
+	bots := m.listBots()
+	sort.Slice(bots, func(i, j int) bool {
+		return bots[i].UniqueId < bots[j].UniqueId
+	})
+	statuses := make([]BotStatus, 0, len(bots))
+	for _, bot := range bots {
+		statuses = append(statuses, bot.Status())
+	}
+	return statuses
+}
+
+// 通过接口添加 bot, 重启后需要重新添加, 长期使用的 bot 应写入配置文件
+func (m *MidJourneyService) AddBot(config DiscordBotConfig) (status BotStatus, err error) {
+	if config.UniqueId == "" || config.DiscordToken == "" || config.DiscordAppId == "" || config.DiscordChannelId == "" {
+		err = ErrInvalidBotConfig
+		return
+	}
+	if _, err = ParseJobMode(config.DefaultJobMode); err != nil {
+		return
+	}
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	m.botMapMutex.Lock()
+	existing := m.getBotByUniqueId(config.UniqueId)
+	m.botMapMutex.Unlock()
+	if existing != nil && !existing.Retired() {
+		err = ErrBotExists
+		return
+	}
+	bot, err := m.addBot(config, false)
+	if err != nil {
+		return
+	}
+	delete(m.removedBots, config.UniqueId)
+	logger.Infof("bot %s is added by api", config.UniqueId)
+	return bot.Status(), nil
+}
+
+// 移除 bot, 等待任务结束后关闭
+func (m *MidJourneyService) RemoveBot(uniqueId string) error {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	m.botMapMutex.Lock()
+	bot := m.getBotByUniqueId(uniqueId)
+	m.botMapMutex.Unlock()
+	if bot == nil || bot.Retired() {
+		return ErrBotNotFound
+	}
+	if bot.fromConfig {
+		m.removedBots[uniqueId] = true
+	}
+	logger.Infof("bot %s is removed by api", uniqueId)
+	m.retireBot(bot)
+	return nil
+}
+
+// 禁用后不再分配任何任务, 已经发出的请求仍会返回结果
+func (m *MidJourneyService) SetBotEnabled(uniqueId string, enabled bool) (status BotStatus, err error) {
+	m.botMapMutex.Lock()
+	bot := m.getBotByUniqueId(uniqueId)
+	m.botMapMutex.Unlock()
+	if bot == nil || bot.Retired() {
+		err = ErrBotNotFound
+		return
+	}
+	bot.disabled.Store(!enabled)
+	logger.Infof("bot %s is enabled: %t", uniqueId, enabled)
+	return bot.Status(), nil
+}
+
+func (bot *DiscordBot) Status() BotStatus {
+	running, queued := bot.TaskCounts()
+	status := BotStatus{
+		UniqueId:           bot.UniqueId,
+		Health:             bot.Health(),
+		RunningTasks:       running,
+		QueuedTasks:        queued,
+		Weight:             bot.Weight(),
+		Enabled:            bot.Enabled(),
+		Removing:           bot.Retired(),
+		Maintenance:        bot.InMaintenance(),
+		Idle:               bot.Idle(),
+		Source:             "api",
+		JobMode:            bot.JobMode(),
+		FastHoursExhausted: bot.FastHoursExhausted(),
+		InFlightTaskIds:    bot.InFlightTaskIds(),
+	}
+	if bot.fromConfig {
+		status.Source = "config"
+	}
+	return status
+}
+
+func connectionChanged(old, new DiscordBotConfig) bool {
+	return old.DiscordToken != new.DiscordToken ||
+		old.DiscordAppId != new.DiscordAppId ||
+		old.DiscordChannelId != new.DiscordChannelId ||
+		old.DiscordSessionId != new.DiscordSessionId ||
+		old.DiscordGuildId != new.DiscordGuildId
+}
+
+// 不影响连接的参数, 例如 weight、upscaleCount、并发上限
+func (bot *DiscordBot) updateConfig(config DiscordBotConfig) {
+	bot.configLock.Lock()
+	defer bot.configLock.Unlock()
+	bot.config = config
+}
+
+// 停止分配新任务, 执行中和排队中的任务结束(或者超时)后关闭连接并移除
+func (m *MidJourneyService) retireBot(bot *DiscordBot) {
+	if bot.retired.Swap(true) {
+		return
+	}
+	go func() {
+		deadline := time.Now().Add(m.drainTimeout)
+		for !bot.Idle() && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Second)
+		}
+		if !bot.Idle() {
+			logger.Warnf("bot %s is still busy after %s, closing anyway", bot.UniqueId, m.drainTimeout)
+		}
+		bot.Close()
+		m.botMapMutex.Lock()
+		delete(m.discordBots, bot.BotId)
+		m.botMapMutex.Unlock()
+		logger.Infof("bot %s is closed", bot.UniqueId)
+	}()
+}
@@ -0,0 +1,244 @@
+package discordmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// 一次任务中最多点击的次数, 避免按钮文案变化后反复点击
+const maxSettingsActions = 10
+
+// 返回缓存的设置, 没有缓存时 exist 为 false
+func (bot *DiscordBot) GetSettings() (settings BotSettings, exist bool) {
+	bot.settingsLock.RLock()
+	defer bot.settingsLock.RUnlock()
+	if bot.currentSettings == nil {
+		return
+	}
+	return *bot.currentSettings, true
+}
+
+func (bot *DiscordBot) setSettings(settings BotSettings) {
+	bot.settingsLock.Lock()
+	bot.currentSettings = &settings
+	bot.settingsLock.Unlock()
+	if mode, err := ParseJobMode(settings.JobMode); err == nil && mode != "" {
+		bot.setJobMode(mode)
+	}
+}
+
+func (bot *DiscordBot) SettingsTaskHandler(taskId string, payload json.RawMessage) {
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	taskRuntime, exist := bot.taskRuntimes[taskId]
+	if !exist {
+		bot.logger.Errorf("cannot find task runtime for task: %s", taskId)
+		return
+	}
+	var settingsPayload BotSettingsTaskPayload
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &settingsPayload); err != nil {
+			bot.logger.Errorf("failed to unmarshal settings payload: %s", err.Error())
+			taskRuntime.Response(false, "failed to unmarshal payload", nil)
+			bot.RemoveTaskRuntime(taskId)
+			return
+		}
+	}
+	taskRuntime.settingsTask = true
+	taskRuntime.settingsProfile = settingsPayload.Profile
+	bot.runtimesLock.Unlock()
+	interactionId, status, err := bot.settings(taskId)
+	bot.runtimesLock.Lock()
+	if taskRuntime.responded {
+		return
+	}
+	if err != nil {
+		eMessage := fmt.Sprintf("task %s failed to request, error occured: %s", taskId, err.Error())
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Errorf(eMessage)
+		return
+	}
+	if status >= 400 {
+		eMessage := fmt.Sprintf("task %s failed to request, status code: %d", taskId, status)
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Warnf(eMessage)
+		return
+	}
+	taskRuntime.InteractionId = interactionId
+	taskRuntime.SetRunning()
+}
+
+// /settings 的结果只有组件, 既没有 embed 也没有 attachment
+func (bot *DiscordBot) onSettingsMessageCreate(s *discordgo.Session, event *discordgo.MessageCreate) {
+	if bot.Config().DiscordChannelId != "" && event.ChannelID != bot.Config().DiscordChannelId {
+		return
+	}
+	if event.Interaction == nil || event.Interaction.Name != string(DiscordCommandSettings) {
+		return
+	}
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	if taskRuntime := bot.getSettingsTaskRuntime(event.Message); taskRuntime != nil {
+		bot.onSettingsMessage(taskRuntime, event.Message)
+	}
+}
+
+// 调用时需持有 runtimesLock
+func (bot *DiscordBot) getSettingsTaskRuntime(message *discordgo.Message) *TaskRuntime {
+	if message == nil {
+		return nil
+	}
+	var taskRuntime *TaskRuntime
+	if message.Interaction != nil && message.Interaction.Name == string(DiscordCommandSettings) {
+		taskRuntime = bot.getTaskRuntimeByInteractionId(message.Interaction.ID)
+	}
+	if taskRuntime == nil {
+		taskRuntime = bot.getTaskRuntimeByResponseMessageId(message.ID)
+	}
+	if taskRuntime == nil || !taskRuntime.settingsTask {
+		return nil
+	}
+	return taskRuntime
+}
+
+// 解析当前设置, 与期望的设置不一致时每次点击一个按钮, 等待消息更新后再继续
+func (bot *DiscordBot) onSettingsMessage(taskRuntime *TaskRuntime, message *discordgo.Message) {
+	taskRuntime.ResponseMessageId = message.ID
+	settings := parseBotSettings(message.Components)
+	if len(settings.Buttons) == 0 {
+		return
+	}
+	settings.UpdatedAt = time.Now()
+	bot.setSettings(settings)
+	if taskRuntime.settingsProfile == nil {
+		bot.respondSettings(taskRuntime, true, "", settings)
+		return
+	}
+	customId, values, err := nextSettingsAction(settings, *taskRuntime.settingsProfile)
+	if err != nil {
+		bot.respondSettings(taskRuntime, false, err.Error(), settings)
+		return
+	}
+	if customId == "" {
+		bot.logger.Infof("task %s settings applied, version: %s", taskRuntime.TaskId, settings.Version)
+		bot.respondSettings(taskRuntime, true, "", settings)
+		return
+	}
+	if taskRuntime.settingsActionCount >= maxSettingsActions {
+		bot.respondSettings(taskRuntime, false, "settings did not change after too many actions", settings)
+		return
+	}
+	taskRuntime.settingsActionCount += 1
+	var commandPayload []byte
+	if values != nil {
+		commandPayload, err = bot.buildSelectMenuPayload(customId, message.ID, int(message.Flags), values)
+	} else {
+		commandPayload, err = bot.buildComponentInteractionPayload(message.ID, int(message.Flags), UpSampleData{
+			ComponentType: 2,
+			CustomID:      customId,
+		})
+	}
+	if err != nil {
+		bot.respondSettings(taskRuntime, false, err.Error(), settings)
+		return
+	}
+	if status, err := bot.executeMessageComponent(commandPayload); err != nil || status >= 400 {
+		bot.respondSettings(taskRuntime, false, fmt.Sprintf("failed to change settings, status: %d, err: %v", status, err), settings)
+	}
+}
+
+func (bot *DiscordBot) respondSettings(taskRuntime *TaskRuntime, successful bool, message string, settings BotSettings) {
+	if !successful {
+		bot.logger.Warnf("task %s failed to apply settings: %s", taskRuntime.TaskId, message)
+	}
+	taskRuntime.Response(successful, message, settings)
+	bot.RemoveTaskRuntime(taskRuntime.TaskId)
+}
+
+// 返回下一个需要点击的按钮, 选择菜单时 values 不为空; customId 为空说明已经满足期望的设置
+func nextSettingsAction(settings BotSettings, profile BotSettingsProfile) (customId string, values []string, err error) {
+	if profile.Version != "" {
+		option, found := findVersionOption(settings, profile.Version)
+		if !found || settings.versionMenuId == "" {
+			err = fmt.Errorf("version %s is not available", profile.Version)
+			return
+		}
+		if option.Value != settings.Version {
+			return settings.versionMenuId, []string{option.Value}, nil
+		}
+	}
+	if profile.Stylize != "" && settings.Stylize != strings.ToLower(profile.Stylize) {
+		return findSettingsButton(settings, "stylize "+profile.Stylize)
+	}
+	if profile.RawMode != nil && *profile.RawMode != settings.RawMode {
+		return findSettingsButton(settings, "raw mode")
+	}
+	if profile.RemixMode != nil && *profile.RemixMode != settings.RemixMode {
+		return findSettingsButton(settings, "remix mode")
+	}
+	if profile.Visibility != "" && settings.Visibility != strings.ToLower(profile.Visibility) {
+		if customId, values, err = findSettingsButton(settings, profile.Visibility+" mode"); err == nil {
+			return
+		}
+		// 没有 stealth 按钮时, 取消 public mode 即为 stealth
+		return findSettingsButton(settings, "public mode")
+	}
+	if profile.VariationMode != "" && settings.VariationMode != strings.ToLower(profile.VariationMode) {
+		return findSettingsButton(settings, profile.VariationMode+" variation mode")
+	}
+	return
+}
+
+func findSettingsButton(settings BotSettings, label string) (customId string, values []string, err error) {
+	for _, button := range settings.Buttons {
+		if strings.EqualFold(button.Label, label) {
+			return button.CustomId, nil, nil
+		}
+	}
+	err = fmt.Errorf("button %s not found", label)
+	return
+}
+
+// version 可以是选项的值, 也可以是选项名称, 例如 5.2 可以匹配 "Midjourney Model V5.2"
+func findVersionOption(settings BotSettings, version string) (SettingsVersionOption, bool) {
+	version = strings.ToLower(strings.TrimSpace(version))
+	for _, option := range settings.VersionOptions {
+		label := strings.ToLower(option.Label)
+		if strings.ToLower(option.Value) == version || label == version || strings.HasSuffix(label, " v"+version) {
+			return option, true
+		}
+	}
+	return SettingsVersionOption{}, false
+}
+
+// 校验配置中的取值
+func validateSettingsProfile(profile BotSettingsProfile) bool {
+	if profile.Stylize != "" {
+		switch strings.ToLower(profile.Stylize) {
+		case "low", "med", "high", "very high":
+		default:
+			return false
+		}
+	}
+	if profile.Visibility != "" {
+		switch strings.ToLower(profile.Visibility) {
+		case "public", "stealth":
+		default:
+			return false
+		}
+	}
+	if profile.VariationMode != "" {
+		switch strings.ToLower(profile.VariationMode) {
+		case "high", "low":
+		default:
+			return false
+		}
+	}
+	return true
+}
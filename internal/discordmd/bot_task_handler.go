@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"mime/multipart"
+	"strconv"
 )
 
 // taskHandler 只负责请求的发起，并不负责获取结果，因为在discord内，所有的interaction都为异步执行的
@@ -26,12 +27,18 @@ func (bot *DiscordBot) ImagineTaskHandler(taskId string, payload json.RawMessage
 		return
 	}
 
-	if taskPayload.FastMode {
-		bot.switchFastMode(true)
-		defer bot.switchFastMode(false)
-	}
+	mode := bot.resolveJobMode(taskPayload.Mode)
+	taskRuntime.JobMode = mode
+	taskRuntime.imaginePayload = &taskPayload
 
-	interactionId, statusCode, err := bot.imagine(taskId, taskPayload.Prompt)
+	// 等待 interaction id 时释放锁, 不阻塞事件处理以及同一个 bot 上的其他指令
+	bot.runtimesLock.Unlock()
+	interactionId, statusCode, err := bot.imagineInJobMode(taskId, taskPayload.Prompt, mode)
+	bot.runtimesLock.Lock()
+	// 发送期间结果可能已经返回, 或者任务已经因超时、bot 关闭而失败, 不再重复返回
+	if taskRuntime.responded {
+		return
+	}
 	if err != nil {
 		eMessage := fmt.Sprintf("imagine task %s failed to request, error occured: %s", taskId, err.Error())
 		taskRuntime.Response(false, eMessage, nil)
@@ -46,7 +53,8 @@ func (bot *DiscordBot) ImagineTaskHandler(taskId string, payload json.RawMessage
 		return
 	}
 	taskRuntime.InteractionId = interactionId
-	bot.logger.Infof("imagine task %s is starting, fast: %t, autoUpscale: %t, prompt: %s", taskId, taskPayload.FastMode, taskPayload.AutoUpscale, taskPayload.Prompt)
+	taskRuntime.SetRunning()
+	bot.logger.Infof("imagine task %s is starting, mode: %s, autoUpscale: %t, prompt: %s", taskId, mode, taskPayload.AutoUpscale, taskPayload.Prompt)
 	// 创建任务成功时，不需要返回结果，当前结果在eventHandler中才返回
 }
 
@@ -78,10 +86,78 @@ func (bot *DiscordBot) UpscaleTaskHandler(taskId string, payload json.RawMessage
 		eMessage := fmt.Sprintf("task %s failed to request, status code: %d", taskId, status)
 		taskRuntime.Response(false, eMessage, nil)
 		bot.logger.Warnf(eMessage)
+		return
 	}
+	taskRuntime.AddPendingUpscale(taskPayload.Index)
 	bot.logger.Infof("upscale task %s is starting, originImageId: %s, index: %d", taskId, taskPayload.OriginImageId, taskPayload.Index)
 }
 
+func (bot *DiscordBot) VariationTaskHandler(taskId string, payload json.RawMessage) {
+	var taskPayload ImageVariationTaskPayload
+	bot.childTaskHandler(taskId, payload, &taskPayload, func() (int, error) {
+		return bot.variation(taskPayload.OriginImageId, taskPayload.Index, taskPayload.OriginImageMessageId)
+	})
+}
+
+func (bot *DiscordBot) RerollTaskHandler(taskId string, payload json.RawMessage) {
+	var taskPayload ImageRerollTaskPayload
+	bot.childTaskHandler(taskId, payload, &taskPayload, func() (int, error) {
+		return bot.reroll(taskPayload.OriginImageId, taskPayload.OriginImageMessageId)
+	})
+}
+
+func (bot *DiscordBot) OutpaintTaskHandler(taskId string, payload json.RawMessage) {
+	var taskPayload ImageOutpaintTaskPayload
+	bot.childTaskHandler(taskId, payload, &taskPayload, func() (int, error) {
+		if taskPayload.Action == OutpaintActionCustomZoom {
+			return bot.customZoom(taskPayload.UpscaledImageId, taskPayload.UpscaledMessageId, taskPayload.Zoom, taskPayload.Prompt)
+		}
+		return bot.outpaint(taskPayload.UpscaledImageId, taskPayload.Action, taskPayload.UpscaledMessageId)
+	})
+}
+
+// variation、reroll、outpaint 等子任务都是点击父任务消息上的按钮, 结果为新的四宫格
+func (bot *DiscordBot) childTaskHandler(taskId string, payload json.RawMessage, taskPayload interface{}, click func() (int, error)) {
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	taskRuntime, exist := bot.taskRuntimes[taskId]
+	if !exist {
+		bot.logger.Errorf("cannot find task runtime for task: %s", taskId)
+		return
+	}
+
+	if err := json.Unmarshal(payload, taskPayload); err != nil {
+		eMessage := fmt.Sprintf("task %s failed to unmarshal payload: %s", taskId, err.Error())
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Errorf(eMessage)
+		return
+	}
+	// custom zoom 需要等待弹窗, 点击期间不持有锁
+	bot.runtimesLock.Unlock()
+	status, err := click()
+	bot.runtimesLock.Lock()
+	if taskRuntime.responded {
+		return
+	}
+	if err != nil {
+		eMessage := fmt.Sprintf("task %s failed to request, error occured: %s", taskId, err.Error())
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Errorf(eMessage)
+		return
+	}
+	if status >= 400 {
+		eMessage := fmt.Sprintf("task %s failed to request, status code: %d", taskId, status)
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Warnf(eMessage)
+		return
+	}
+	taskRuntime.SetRunning()
+	bot.logger.Infof("child task %s is starting, parent task: %s, payload: %s", taskId, taskRuntime.ParentTaskId, string(payload))
+}
+
 func (bot *DiscordBot) DescribeTaskHandler(taskId string, payload json.RawMessage) {
 	bot.runtimesLock.Lock()
 	defer bot.runtimesLock.Unlock()
@@ -132,7 +208,12 @@ func (bot *DiscordBot) DescribeTaskHandler(taskId string, payload json.RawMessag
 		return
 	}
 
-	interactionid, status, err := bot.describe(taskPayload.ImageFileName, uploadFilename)
+	bot.runtimesLock.Unlock()
+	interactionid, status, err := bot.describe(taskId, taskPayload.ImageFileName, uploadFilename)
+	bot.runtimesLock.Lock()
+	if taskRuntime.responded {
+		return
+	}
 	if err != nil {
 		eMessage := fmt.Sprintf("task %s failed to request, error occured: %s", taskId, err.Error())
 		taskRuntime.Response(false, eMessage, nil)
@@ -146,5 +227,128 @@ func (bot *DiscordBot) DescribeTaskHandler(taskId string, payload json.RawMessag
 	}
 
 	taskRuntime.InteractionId = interactionid
+	taskRuntime.SetRunning()
 	bot.logger.Infof("describe task %s is starting, imageFileName: %s", taskId, taskPayload.ImageFileName)
 }
+
+func (bot *DiscordBot) BlendTaskHandler(taskId string, payload json.RawMessage) {
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	taskRuntime, exist := bot.taskRuntimes[taskId]
+	if !exist {
+		bot.logger.Errorf("cannot find task runtime for task: %s", taskId)
+		return
+	}
+
+	var taskPayload ImageBlendTaskPayload
+	if err := json.Unmarshal(payload, &taskPayload); err != nil {
+		eMessage := fmt.Sprintf("task %s failed to unmarshal payload: %s", taskId, err.Error())
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Errorf(eMessage)
+		return
+	}
+
+	fileHeadersI, exist := bot.FileHeaders.LoadAndDelete(taskId)
+	if !exist {
+		eMessage := fmt.Sprintf("task %s failed to get image file headers", taskId)
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Errorf(eMessage)
+		return
+	}
+	fileHeaders, ok := fileHeadersI.([]*multipart.FileHeader)
+	if !ok {
+		eMessage := fmt.Sprintf("task %s failed to assert image file headers", taskId)
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Errorf(eMessage)
+		return
+	}
+
+	// 每张图片都先上传为 discord attachment, attachment id 与选项的 value 对应
+	attachments := make([]AttachmentInCommand, 0, len(fileHeaders))
+	for i, fileHeader := range fileHeaders {
+		uploadFilename, err := bot.uploadFileHeaderToAttachment(fileHeader, taskPayload.ImageFileNames[i], strconv.Itoa(i), taskPayload.ImageFileSizes[i])
+		if err != nil {
+			eMessage := fmt.Sprintf("task %s failed to upload image file %s: %s", taskId, taskPayload.ImageFileNames[i], err.Error())
+			taskRuntime.Response(false, eMessage, nil)
+			bot.RemoveTaskRuntime(taskId)
+			bot.logger.Errorf(eMessage)
+			return
+		}
+		attachments = append(attachments, AttachmentInCommand{
+			Id:               strconv.Itoa(i),
+			Filename:         taskPayload.ImageFileNames[i],
+			UploadedFilename: uploadFilename,
+		})
+	}
+
+	bot.runtimesLock.Unlock()
+	interactionId, status, err := bot.blend(taskId, attachments, taskPayload.Dimensions)
+	bot.runtimesLock.Lock()
+	if taskRuntime.responded {
+		return
+	}
+	if err != nil {
+		eMessage := fmt.Sprintf("task %s failed to request, error occured: %s", taskId, err.Error())
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Errorf(eMessage)
+		return
+	}
+	if status >= 400 {
+		eMessage := fmt.Sprintf("task %s failed to request, status code: %d", taskId, status)
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Warnf(eMessage)
+		return
+	}
+
+	taskRuntime.InteractionId = interactionId
+	taskRuntime.SetRunning()
+	bot.logger.Infof("blend task %s is starting, images: %d, dimensions: %s", taskId, len(attachments), taskPayload.Dimensions)
+}
+
+func (bot *DiscordBot) ShortenTaskHandler(taskId string, payload json.RawMessage) {
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	taskRuntime, exist := bot.taskRuntimes[taskId]
+	if !exist {
+		bot.logger.Errorf("cannot find task runtime for task: %s", taskId)
+		return
+	}
+
+	var taskPayload PromptShortenTaskPayload
+	if err := json.Unmarshal(payload, &taskPayload); err != nil {
+		eMessage := fmt.Sprintf("task %s failed to unmarshal payload: %s", taskId, err.Error())
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Errorf(eMessage)
+		return
+	}
+
+	bot.runtimesLock.Unlock()
+	interactionId, status, err := bot.shorten(taskId, taskPayload.Prompt)
+	bot.runtimesLock.Lock()
+	if taskRuntime.responded {
+		return
+	}
+	if err != nil {
+		eMessage := fmt.Sprintf("task %s failed to request, error occured: %s", taskId, err.Error())
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Errorf(eMessage)
+		return
+	}
+	if status >= 400 {
+		eMessage := fmt.Sprintf("task %s failed to request, status code: %d", taskId, status)
+		taskRuntime.Response(false, eMessage, nil)
+		bot.RemoveTaskRuntime(taskId)
+		bot.logger.Warnf(eMessage)
+		return
+	}
+	taskRuntime.InteractionId = interactionId
+	taskRuntime.SetRunning()
+	bot.logger.Infof("shorten task %s is starting, prompt: %s", taskId, taskPayload.Prompt)
+}
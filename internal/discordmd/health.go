@@ -0,0 +1,225 @@
+package discordmd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type BotHealthState string
+
+const (
+	BotHealthStateHealthy      BotHealthState = "healthy"
+	BotHealthStateDegraded     BotHealthState = "degraded"     // 最近有请求失败, 仍然可以调度, 但优先使用健康的 bot
+	BotHealthStateQuarantined  BotHealthState = "quarantined"  // 连续失败或者账号需要人工处理, 不再分配新任务
+	BotHealthStateDisconnected BotHealthState = "disconnected" // gateway 断开, 无法收到任务结果
+)
+
+var (
+	// 出现这些提示时账号需要人工处理, 直接隔离
+	QuarantineEmbededMessageTitles = map[string]struct{}{
+		"Action needed to continue":   {},
+		"Action required to continue": {},
+		"Job action restricted":       {},
+	}
+)
+
+type BotHealth struct {
+	State BotHealthState `json:"state"`
+
+	Reason string `json:"reason"`
+
+	Connected bool `json:"connected"`
+
+	DisconnectedAt *time.Time `json:"disconnected_at,omitempty"`
+
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	QuarantinedUntil *time.Time `json:"quarantined_until,omitempty"` // 到期后通过 /info 探测, 成功则恢复
+
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+
+	LastFailureAt *time.Time `json:"last_failure_at,omitempty"`
+
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// 根据 gateway 事件与请求结果维护 bot 的健康状态
+type botHealthTracker struct {
+	health BotHealth
+
+	quarantineFailures int // 连续失败达到该次数后隔离
+
+	quarantineDuration time.Duration
+
+	lock sync.Mutex
+
+	logger func(template string, args ...interface{})
+}
+
+func newBotHealthTracker(logger func(template string, args ...interface{})) *botHealthTracker {
+	return &botHealthTracker{
+		health: BotHealth{
+			State:     BotHealthStateHealthy,
+			Connected: true,
+			ChangedAt: time.Now(),
+		},
+		quarantineFailures: 3,
+		quarantineDuration: 10 * time.Minute,
+		logger:             logger,
+	}
+}
+
+// 调用时需持有 lock
+func (t *botHealthTracker) setState(state BotHealthState, reason string) {
+	if t.health.State == state && t.health.Reason == reason {
+		return
+	}
+	t.logger("bot health changed from %s to %s, reason: %s", t.health.State, state, reason)
+	t.health.State = state
+	t.health.Reason = reason
+	t.health.ChangedAt = time.Now()
+	if state != BotHealthStateQuarantined {
+		t.health.QuarantinedUntil = nil
+	}
+}
+
+func (t *botHealthTracker) recordSuccess() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	t.health.LastSuccessAt = &now
+	t.health.ConsecutiveFailures = 0
+	// 隔离中的 bot 只能通过探测恢复, 避免与隔离原因无关的请求(例如 upscale)使其提前恢复
+	if t.health.Connected && t.health.State == BotHealthStateDegraded {
+		t.setState(BotHealthStateHealthy, "")
+	}
+}
+
+func (t *botHealthTracker) recordFailure(reason string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	t.health.LastFailureAt = &now
+	t.health.ConsecutiveFailures++
+	if !t.health.Connected || t.health.State == BotHealthStateQuarantined {
+		return
+	}
+	if t.health.ConsecutiveFailures >= t.quarantineFailures {
+		t.quarantineLocked(reason)
+		return
+	}
+	t.setState(BotHealthStateDegraded, reason)
+}
+
+func (t *botHealthTracker) quarantine(reason string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.quarantineLocked(reason)
+}
+
+func (t *botHealthTracker) quarantineLocked(reason string) {
+	until := time.Now().Add(t.quarantineDuration)
+	t.setState(BotHealthStateQuarantined, reason)
+	t.health.QuarantinedUntil = &until
+}
+
+func (t *botHealthTracker) setConnected(connected bool, reason string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.health.Connected = connected
+	if !connected {
+		if t.health.DisconnectedAt == nil {
+			now := time.Now()
+			t.health.DisconnectedAt = &now
+		}
+		// 隔离中的 bot 断开后仍保持隔离, 重连后需要探测才能恢复
+		if t.health.State != BotHealthStateQuarantined {
+			t.setState(BotHealthStateDisconnected, reason)
+		}
+		return
+	}
+	t.health.DisconnectedAt = nil
+	if t.health.State == BotHealthStateDisconnected {
+		t.health.ConsecutiveFailures = 0
+		t.setState(BotHealthStateHealthy, reason)
+	}
+}
+
+// 探测成功后恢复, 失败时延长隔离时间
+func (t *botHealthTracker) recordProbe(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.health.State != BotHealthStateQuarantined {
+		return
+	}
+	if err != nil {
+		t.quarantineLocked("probe failed: " + err.Error())
+		return
+	}
+	t.health.ConsecutiveFailures = 0
+	t.setState(BotHealthStateHealthy, "probe succeeded")
+}
+
+func (t *botHealthTracker) snapshot() BotHealth {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.health
+}
+
+func (bot *DiscordBot) Health() BotHealth {
+	return bot.health.snapshot()
+}
+
+// 隔离到期, 需要探测
+func (bot *DiscordBot) needsProbe() bool {
+	health := bot.Health()
+	return health.Connected && health.State == BotHealthStateQuarantined && health.QuarantinedUntil != nil && time.Now().After(*health.QuarantinedUntil)
+}
+
+// 断开超过 timeout 仍未自动恢复, 需要重连
+func (bot *DiscordBot) needsReconnect(timeout time.Duration) bool {
+	health := bot.Health()
+	return !health.Connected && health.DisconnectedAt != nil && time.Since(*health.DisconnectedAt) > timeout
+}
+
+func (bot *DiscordBot) onGatewayConnect(s *discordgo.Session, event *discordgo.Connect) {
+	bot.health.setConnected(true, "gateway connected")
+}
+
+func (bot *DiscordBot) onGatewayResumed(s *discordgo.Session, event *discordgo.Resumed) {
+	bot.health.setConnected(true, "gateway resumed")
+}
+
+func (bot *DiscordBot) onGatewayDisconnect(s *discordgo.Session, event *discordgo.Disconnect) {
+	bot.health.setConnected(false, "gateway disconnected")
+}
+
+// discordgo 会自动重连, 长时间未恢复时重新建立连接
+func (bot *DiscordBot) reconnect() error {
+	bot.logger.Infof("reconnecting to discord gateway")
+	bot.discordSession.Close()
+	return bot.discordSession.Open()
+}
+
+// 优先选择健康的 bot, 没有时使用 degraded 的 bot, 隔离、断开、禁用、维护中以及正在移除的 bot 不参与调度
+func filterSchedulableBots(bots []*DiscordBot) []*DiscordBot {
+	healthy := make([]*DiscordBot, 0, len(bots))
+	degraded := make([]*DiscordBot, 0, len(bots))
+	for _, bot := range bots {
+		if bot.Retired() || !bot.Enabled() || bot.InMaintenance() {
+			continue
+		}
+		switch bot.Health().State {
+		case BotHealthStateHealthy:
+			healthy = append(healthy, bot)
+		case BotHealthStateDegraded:
+			degraded = append(degraded, bot)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+	return degraded
+}
@@ -0,0 +1,169 @@
+package discordmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type JobMode string
+
+const (
+	JobModeFast  JobMode = "fast"
+	JobModeRelax JobMode = "relax"
+	JobModeTurbo JobMode = "turbo" // 比 fast 更快, 消耗双倍的 fast 时长
+)
+
+var (
+	// fast 时长用完时的提示, 任务会改为 relax 模式重新提交
+	FastHoursExhaustedEmbededMessageTitles = map[string]struct{}{
+		"Fast hours exhausted":           {},
+		"Out of fast hours":              {},
+		"You have run out of fast hours": {},
+	}
+)
+
+// 为空表示不指定, /info 中的 relaxed 视为 relax
+func ParseJobMode(mode string) (JobMode, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "":
+		return "", nil
+	case string(JobModeFast):
+		return JobModeFast, nil
+	case string(JobModeRelax), "relaxed":
+		return JobModeRelax, nil
+	case string(JobModeTurbo):
+		return JobModeTurbo, nil
+	}
+	return "", ErrInvalidJobMode
+}
+
+func (mode JobMode) consumesFastHours() bool {
+	return mode == JobModeFast || mode == JobModeTurbo
+}
+
+func (mode JobMode) command() DiscordCommand {
+	switch mode {
+	case JobModeFast:
+		return DiscordCommandFast
+	case JobModeTurbo:
+		return DiscordCommandTurbo
+	}
+	return DiscordCommandRelax
+}
+
+func (bot *DiscordBot) JobMode() JobMode {
+	bot.jobModeLock.RLock()
+	defer bot.jobModeLock.RUnlock()
+	return bot.jobMode
+}
+
+// /info、/settings 的结果以及切换成功后更新
+func (bot *DiscordBot) setJobMode(mode JobMode) {
+	bot.jobModeLock.Lock()
+	defer bot.jobModeLock.Unlock()
+	if mode != bot.jobMode {
+		bot.logger.Infof("job mode changed from %q to %q", bot.jobMode, mode)
+	}
+	bot.jobMode = mode
+}
+
+func (bot *DiscordBot) FastHoursExhausted() bool {
+	return bot.fastHoursExhausted.Load()
+}
+
+// 任务实际使用的模式: 没有指定时使用配置的默认模式, 都为空时使用 relax, 与原来 fast_mode 为 false 时一致,
+// 不会沿用上一个任务切换后的模式; fast 时长用完后 fast、turbo 退回 relax
+func (bot *DiscordBot) resolveJobMode(mode JobMode) JobMode {
+	if mode == "" {
+		mode, _ = ParseJobMode(bot.Config().DefaultJobMode)
+	}
+	if mode == "" {
+		mode = JobModeRelax
+	}
+	if mode.consumesFastHours() && bot.FastHoursExhausted() {
+		bot.logger.Infof("fast hours exhausted, using relax mode instead of %s", mode)
+		return JobModeRelax
+	}
+	return mode
+}
+
+// 只有模式未知或者与目标模式不同时才发送 /fast、/relax、/turbo
+func (bot *DiscordBot) ensureJobMode(mode JobMode) error {
+	if mode == "" || bot.JobMode() == mode {
+		return nil
+	}
+	_, status, err := bot.switchJobMode(mode)
+	if err != nil {
+		return err
+	}
+	if status >= 400 {
+		return fmt.Errorf("failed to switch to %s mode, status code: %d", mode, status)
+	}
+	bot.setJobMode(mode)
+	return nil
+}
+
+// 账号信息中的 fast 时长为 0 时视为用完, 重新获取到剩余时长后恢复
+func (bot *DiscordBot) updateFastHours(info AccountInfo) {
+	exhausted := info.FastHoursTotal > 0 && info.FastHoursRemaining <= 0
+	if bot.fastHoursExhausted.Swap(exhausted) != exhausted {
+		bot.logger.Infof("fast hours exhausted: %t, remaining: %s", exhausted, info.FastTimeRemaining)
+	}
+}
+
+// fast 时长用完导致失败的 imagine 任务改为 relax 模式重新排队, 调用时需持有 runtimesLock
+func (bot *DiscordBot) retryInRelaxMode(taskRuntime *TaskRuntime) bool {
+	if taskRuntime.imaginePayload == nil || !taskRuntime.JobMode.consumesFastHours() {
+		return false
+	}
+	taskPayload := *taskRuntime.imaginePayload
+	taskPayload.Mode = JobModeRelax
+	payload, err := json.Marshal(taskPayload)
+	if err != nil {
+		return false
+	}
+	bot.logger.Infof("task %s is retried in relax mode", taskRuntime.TaskId)
+	taskRuntime.InteractionId = ""
+	taskRuntime.SetState(TaskStateQueued)
+	bot.taskQueue.Push(&MidjourneyTask{
+		TaskId:   taskRuntime.TaskId,
+		TaskType: MidjourneyTaskTypeImageGeneration,
+		Payload:  payload,
+	})
+	return true
+}
+
+// 都没有 fast 时长时不做筛选, 由 bot 退回 relax 执行
+func preferFastHoursBots(bots []*DiscordBot, mode JobMode) []*DiscordBot {
+	if !mode.consumesFastHours() {
+		return bots
+	}
+	available := make([]*DiscordBot, 0, len(bots))
+	for _, bot := range bots {
+		if !bot.FastHoursExhausted() {
+			available = append(available, bot)
+		}
+	}
+	if len(available) == 0 {
+		return bots
+	}
+	return available
+}
+
+// 需要切换模式时独占, 切换与提交之间不会插入其他模式的任务; 模式相同的 imagine 可以同时提交
+func (bot *DiscordBot) imagineInJobMode(taskId, prompt string, mode JobMode) (interactionId string, status int, err error) {
+	bot.jobModeSwitchLock.RLock()
+	if mode == "" || bot.JobMode() == mode {
+		defer bot.jobModeSwitchLock.RUnlock()
+		return bot.imagine(taskId, prompt)
+	}
+	bot.jobModeSwitchLock.RUnlock()
+	bot.jobModeSwitchLock.Lock()
+	defer bot.jobModeSwitchLock.Unlock()
+	if err := bot.ensureJobMode(mode); err != nil {
+		// 切换失败时仍以账号当前的模式执行
+		bot.logger.Warnf("task %s failed to switch to %s mode, err: %s", taskId, mode, err)
+	}
+	return bot.imagine(taskId, prompt)
+}
@@ -2,26 +2,92 @@ package discordmd
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
+type ServiceConfig struct {
+	TaskRetention time.Duration `mapstructure:"taskRetention"` // 任务结束后, 状态记录在内存中的保留时间
+
+	TaskStoreRetention time.Duration `mapstructure:"taskStoreRetention"` // 任务结束后, 持久化记录的保留时间, 默认 720h, 不会短于 taskRetention
+
+	AccountInfoRefreshInterval time.Duration `mapstructure:"accountInfoRefreshInterval"` // 定期执行 /info 刷新账号信息的间隔
+
+	StorePath string `mapstructure:"storePath"` // 任务持久化文件路径, 为空时不持久化
+
+	MaxInFlightTasks int `mapstructure:"maxInFlightTasks"` // 所有 bot 同时执行的任务上限, 0 表示不限制
+
+	MaxQueuedTasks int `mapstructure:"maxQueuedTasks"` // 所有 bot 排队中的任务上限
+
+	Scheduler SchedulerStrategy `mapstructure:"scheduler"` // random, least_loaded, weighted_round_robin, fast_hours, 默认 least_loaded
+
+	HealthCheckInterval time.Duration `mapstructure:"healthCheckInterval"` // 检查断开以及隔离到期的 bot 的间隔, 默认 1m
+
+	QuarantineFailures int `mapstructure:"quarantineFailures"` // 连续请求失败多少次后隔离 bot, 默认 3
+
+	QuarantineDuration time.Duration `mapstructure:"quarantineDuration"` // 隔离多久之后探测, 默认 10m
+
+	DrainTimeout time.Duration `mapstructure:"drainTimeout"` // 配置中移除 bot 后等待其任务结束的最长时间, 默认 30m
+
+	TaskTimeout time.Duration `mapstructure:"taskTimeout"` // 任务等待结果的最长时间, 超时后标记为失败, 默认 60m
+}
+
+// bot 的健康状态与负载, 用于监控
+type BotStatus struct {
+	UniqueId string `json:"unique_id"`
+
+	Health BotHealth `json:"health"`
+
+	RunningTasks int `json:"running_tasks"`
+
+	QueuedTasks int `json:"queued_tasks"`
+
+	Weight int `json:"weight"`
+
+	Enabled bool `json:"enabled"`
+
+	Removing bool `json:"removing"` // 已被移除, 等待任务结束后关闭
+
+	Maintenance bool `json:"maintenance"`
+
+	Idle bool `json:"idle"` // 没有执行中以及排队中的任务, 维护模式下可以安全地替换账号
+
+	Source string `json:"source"` // config 或 api
+
+	JobMode JobMode `json:"job_mode"` // 账号当前的模式, 还没有获取到时为空
+
+	FastHoursExhausted bool `json:"fast_hours_exhausted"`
+
+	InFlightTaskIds []string `json:"in_flight_task_ids"`
+}
+
 type DiscordBotConfig struct {
-	UniqueId string `mapstructure:"uniqueId"`
+	UniqueId string `mapstructure:"uniqueId" json:"unique_id"`
+
+	DiscordToken string `mapstructure:"discordToken" json:"discord_token"`
+
+	DiscordAppId string `mapstructure:"discordAppId" json:"discord_app_id"` // midjourney application id
+
+	DiscordChannelId string `mapstructure:"discordChannelId" json:"discord_channel_id"` // midjourney channel id
 
-	DiscordToken string `mapstructure:"discordToken"`
+	DiscordSessionId string `mapstructure:"discordSessionId" json:"discord_session_id"` // midjourney session id
 
-	DiscordAppId string `mapstructure:"discordAppId"` // midjourney application id
+	DiscordGuildId string `mapstructure:"discordGuildId" json:"discord_guild_id"` // midjourney guild id
 
-	DiscordChannelId string `mapstructure:"discordChannelId"` // midjourney channel id
+	UpscaleCount int `mapstructure:"upscaleCount" json:"upscale_count"`
 
-	DiscordSessionId string `mapstructure:"discordSessionId"` // midjourney session id
+	Weight int `mapstructure:"weight" json:"weight"` // weighted_round_robin 调度时的权重, 默认为 1
 
-	DiscordGuildId string `mapstructure:"discordGuildId"` // midjourney guild id
+	Settings *BotSettingsProfile `mapstructure:"settings" json:"settings"` // 启动时强制应用的 /settings 配置
 
-	UpscaleCount int `mapstructure:"upscaleCount"`
+	MaxInFlightTasks int `mapstructure:"maxInFlightTasks" json:"max_in_flight_tasks"` // 同时发送给 midjourney 的任务上限, 0 表示不限制
 
-	// MaxUnfinishedTasks int `mapstructure:"maxUnfinishedTasks"`
+	MaxQueuedTasks int `mapstructure:"maxQueuedTasks" json:"max_queued_tasks"` // 达到执行上限后最多排队的任务数量
+
+	MaxConcurrentCommands int `mapstructure:"maxConcurrentCommands" json:"max_concurrent_commands"` // 同时发送、等待 interaction id 的指令数量, 默认 3
+
+	DefaultJobMode string `mapstructure:"defaultJobMode" json:"default_job_mode"` // fast、relax 或 turbo, 任务没有指定模式时使用, 为空时使用 relax
 }
 
 type InteractionRequestWrapper struct {
@@ -53,6 +119,32 @@ type InteractionRequestTypeThree struct {
 	ApplicationID string      `json:"application_id"`
 	SessionID     string      `json:"session_id"`
 	Data          interface{} `json:"data"`
+	Nonce         string      `json:"nonce,omitempty"`
+}
+
+// 弹窗(modal)以及其中的输入框, 提交弹窗时按原来的结构填写 value
+type ModalComponent struct {
+	Type       int              `json:"type"`
+	CustomID   string           `json:"custom_id,omitempty"`
+	Value      string           `json:"value,omitempty"`
+	Components []ModalComponent `json:"components,omitempty"`
+}
+
+// 提交弹窗, 与点击按钮不同, 不需要 message_id
+type ModalSubmitRequest struct {
+	Type          int             `json:"type"`
+	ApplicationID string          `json:"application_id"`
+	ChannelID     string          `json:"channel_id"`
+	GuildID       string          `json:"guild_id"`
+	SessionID     string          `json:"session_id"`
+	Data          ModalSubmitData `json:"data"`
+	Nonce         string          `json:"nonce"`
+}
+
+type ModalSubmitData struct {
+	ID         string           `json:"id"`
+	CustomID   string           `json:"custom_id"`
+	Components []ModalComponent `json:"components"`
 }
 
 type InteractionRequestData struct {
@@ -65,6 +157,13 @@ type InteractionRequestData struct {
 	Attachments        []interface{}                                        `json:"attachments"`
 }
 
+type SelectMenuData struct {
+	ComponentType int      `json:"component_type"`
+	CustomID      string   `json:"custom_id"`
+	Type          int      `json:"type"`
+	Values        []string `json:"values"`
+}
+
 type InteractionRequestApplicationCommand struct {
 	ID                       string      `json:"id"`
 	ApplicationID            string      `json:"application_id"`
@@ -83,20 +182,39 @@ const (
 	MidjourneyTaskTypeImageGeneration MidjourneyTaskType = "image_generation"
 	MidjourneyTaskTypeImageUpscale    MidjourneyTaskType = "image_upscale"
 	MidjourneyTaskTypeImageDescribe   MidjourneyTaskType = "image_describe"
+	MidjourneyTaskTypeImageVariation  MidjourneyTaskType = "image_variation"
+	MidjourneyTaskTypeImageReroll     MidjourneyTaskType = "image_reroll"
+	MidjourneyTaskTypeImageOutpaint   MidjourneyTaskType = "image_outpaint"
+	MidjourneyTaskTypeImageBlend      MidjourneyTaskType = "image_blend"
+	MidjourneyTaskTypePromptShorten   MidjourneyTaskType = "prompt_shorten"
+	MidjourneyTaskTypeAccountInfo     MidjourneyTaskType = "account_info"
+	MidjourneyTaskTypeBotSettings     MidjourneyTaskType = "bot_settings"
 )
 
+// 是否占用 midjourney 的执行名额, /info、/settings 以及 upscale 不需要排队
+func (t MidjourneyTaskType) consumesJobSlot() bool {
+	switch t {
+	case MidjourneyTaskTypeAccountInfo, MidjourneyTaskTypeBotSettings, MidjourneyTaskTypeImageUpscale:
+		return false
+	}
+	return true
+}
+
 // Task 请求部分
 
 type MidjourneyTask struct {
-	TaskId   string
-	TaskType MidjourneyTaskType
-	Payload  json.RawMessage
+	TaskId     string
+	TaskType   MidjourneyTaskType
+	Payload    json.RawMessage
+	Priority   int // 越大越先执行, 默认为 0, 入队时限制在 -10 到 10 之间
+	EnqueuedAt time.Time
+	seq        uint64 // 入队顺序, 同优先级按先后执行
 }
 
 type ImageGenerationTaskPayload struct {
 	Prompt string `json:"prompt"`
 
-	FastMode bool `json:"fast_mode"`
+	Mode JobMode `json:"mode"` // 为空时使用 bot 的默认模式
 
 	AutoUpscale bool `json:"auto_upscale"`
 }
@@ -107,11 +225,57 @@ type ImageUpscaleTaskPayload struct {
 	OriginImageMessageId string `json:"origin_image_message_id"`
 }
 
+type ImageVariationTaskPayload struct {
+	OriginImageId        string `json:"origin_image_id"`
+	Index                string `json:"index"`
+	OriginImageMessageId string `json:"origin_image_message_id"`
+}
+
+type ImageRerollTaskPayload struct {
+	OriginImageId        string `json:"origin_image_id"`
+	OriginImageMessageId string `json:"origin_image_message_id"`
+}
+
+type OutpaintAction string
+
+const (
+	OutpaintActionZoomOut2x   OutpaintAction = "zoom_out_2x"
+	OutpaintActionZoomOut1_5x OutpaintAction = "zoom_out_1_5x"
+	OutpaintActionMakeSquare  OutpaintAction = "make_square"
+	OutpaintActionPanLeft     OutpaintAction = "pan_left"
+	OutpaintActionPanRight    OutpaintAction = "pan_right"
+	OutpaintActionPanUp       OutpaintAction = "pan_up"
+	OutpaintActionPanDown     OutpaintAction = "pan_down"
+	OutpaintActionCustomZoom  OutpaintAction = "custom_zoom" // 点击后需要在弹窗中提交 prompt 与 --zoom
+)
+
+type ImageOutpaintTaskPayload struct {
+	UpscaledImageId   string         `json:"upscaled_image_id"`
+	UpscaledMessageId string         `json:"upscaled_message_id"`
+	Action            OutpaintAction `json:"action"`
+	Zoom              float64        `json:"zoom,omitempty"`   // custom zoom 的倍数, 1-2
+	Prompt            string         `json:"prompt,omitempty"` // custom zoom 使用的 prompt, 为空时使用弹窗中原来的 prompt
+}
+
 type ImageDescribeTaskPayload struct {
 	ImageFileName string `json:"image_file_name"`
 	ImageFileSize int    `json:"image_file_size"`
 }
 
+type ImageBlendTaskPayload struct {
+	ImageFileNames []string `json:"image_file_names"`
+	ImageFileSizes []int    `json:"image_file_sizes"`
+	Dimensions     string   `json:"dimensions"`
+}
+
+type PromptShortenTaskPayload struct {
+	Prompt string `json:"prompt"`
+}
+
+type BotSettingsTaskPayload struct {
+	Profile *BotSettingsProfile `json:"profile"` // 为空时只读取当前设置
+}
+
 // Task 响应部分
 
 type TaskResult struct {
@@ -126,18 +290,131 @@ type ImageGenerationResultPayload struct {
 	OriginImageURL string `json:"origin_image_url"`
 
 	ImageURLs []string `json:"image_urls"`
+
+	MirroredOriginImageURL string `json:"mirrored_origin_image_url,omitempty"` // 转存后的地址, 未开启转存时为空
+
+	MirroredImageURLs []string `json:"mirrored_image_urls,omitempty"`
+
+	SplitImageURLs []string `json:"split_image_urls,omitempty"` // 四宫格切分后的图片
 }
 
 type ImageUpscaleResultPayload struct {
 	Index string `json:"index"`
 
 	ImageURL string `json:"image_url"`
+
+	MirroredImageURL string `json:"mirrored_image_url,omitempty"`
+}
+
+type UpscaledImage struct {
+	MessageId string `json:"message_id"`
+	ImageId   string `json:"image_id"`
+	ImageURL  string `json:"image_url"`
 }
 
 type ImageDescribeResultPayload struct {
 	Description string `json:"description"`
 }
 
+type ShortenToken struct {
+	Token string `json:"token"`
+
+	Weight float64 `json:"weight"` // 点击 Show Details 后得到, 没有时为 0
+
+	Important bool `json:"important"` // 在结果中加粗显示
+
+	Removed bool `json:"removed"` // 在结果中以删除线显示, 表示可以去掉
+}
+
+type PromptShortenResultPayload struct {
+	Tokens []ShortenToken `json:"tokens"`
+
+	ShortenedPrompts []string `json:"shortened_prompts"`
+}
+
+// /info 的结果
+type AccountInfo struct {
+	Subscription string `json:"subscription"`
+
+	JobMode string `json:"job_mode"`
+
+	VisibilityMode string `json:"visibility_mode"`
+
+	FastTimeRemaining string `json:"fast_time_remaining"`
+
+	FastHoursRemaining float64 `json:"fast_hours_remaining"`
+
+	FastHoursTotal float64 `json:"fast_hours_total"`
+
+	LifetimeUsage string `json:"lifetime_usage"`
+
+	LifetimeImages int `json:"lifetime_images"`
+
+	LifetimeHours float64 `json:"lifetime_hours"`
+
+	RelaxedUsage string `json:"relaxed_usage"`
+
+	QueuedJobsFast int `json:"queued_jobs_fast"`
+
+	QueuedJobsRelax int `json:"queued_jobs_relax"`
+
+	RunningJobs int `json:"running_jobs"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// /settings 消息上的按钮, Selected 为 true 时按钮为绿色
+type SettingsButton struct {
+	Label    string `json:"label"`
+	CustomId string `json:"custom_id"`
+	Selected bool   `json:"selected"`
+}
+
+type SettingsVersionOption struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// 从 /settings 消息的组件中解析出的当前设置
+type BotSettings struct {
+	Version string `json:"version"`
+
+	Stylize string `json:"stylize"` // low, med, high, very high
+
+	RawMode bool `json:"raw_mode"`
+
+	RemixMode bool `json:"remix_mode"`
+
+	Visibility string `json:"visibility"` // public, stealth
+
+	VariationMode string `json:"variation_mode"` // high, low
+
+	JobMode string `json:"job_mode"` // fast, relax, turbo
+
+	VersionOptions []SettingsVersionOption `json:"version_options"`
+
+	versionMenuId string // 版本选择菜单的 custom_id
+
+	Buttons []SettingsButton `json:"buttons"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// 期望的设置, 为空的字段不做修改
+type BotSettingsProfile struct {
+	Version string `mapstructure:"version" json:"version"`
+
+	Stylize string `mapstructure:"stylize" json:"stylize"`
+
+	RawMode *bool `mapstructure:"rawMode" json:"raw_mode"`
+
+	RemixMode *bool `mapstructure:"remixMode" json:"remix_mode"`
+
+	Visibility string `mapstructure:"visibility" json:"visibility"`
+
+	VariationMode string `mapstructure:"variationMode" json:"variation_mode"`
+}
+
 // Attachment 部分
 
 type AttachmentRequest struct {
@@ -170,12 +447,11 @@ type TaskState string
 
 const (
 	TaskStateCreated         TaskState = "created"
+	TaskStateQueued          TaskState = "queued"
+	TaskStateRunning         TaskState = "running"
+	TaskStateCompleted       TaskState = "completed"
+	TaskStateFailed          TaskState = "failed"
 	TaskStateGetOriginImage  TaskState = "get_origin_image"
 	TaskStateAutoUpscaling   TaskState = "auto_upscaling"
 	TaskStateManualUpscaling TaskState = "manual_upscaling"
 )
-
-type SlashCommandResponse struct {
-	Name          string
-	InteractionId string
-}
@@ -4,7 +4,11 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+
+	"github.com/bwmarrin/discordgo"
 )
 
 // calculate hash from prompt and seed
@@ -116,3 +120,269 @@ func getImageIndexFromMessage(message string) string {
 	}
 	return ""
 }
+
+// blend 的 prompt 只有图片链接, 没有 seed, 直接使用消息中的 prompt 计算哈希
+func getHashFromPromptMessage(message string) string {
+	promptRe := regexp.MustCompile(`\*{2}(.+?)\*{2}`)
+	matches := promptRe.FindStringSubmatch(message)
+	if len(matches) < 2 {
+		return ""
+	}
+	h := md5.Sum([]byte(strings.Trim(matches[1], " ")))
+	return hex.EncodeToString(h[:])
+}
+
+// 展开 ActionsRow, 返回消息中的所有按钮与选择菜单
+func flattenComponents(components []discordgo.MessageComponent) (flattened []discordgo.MessageComponent) {
+	for _, component := range components {
+		if row, ok := component.(*discordgo.ActionsRow); ok {
+			flattened = append(flattened, flattenComponents(row.Components)...)
+			continue
+		}
+		flattened = append(flattened, component)
+	}
+	return
+}
+
+func findButtonByLabel(components []discordgo.MessageComponent, label string) *discordgo.Button {
+	for _, component := range flattenComponents(components) {
+		if button, ok := component.(*discordgo.Button); ok && strings.EqualFold(strings.TrimSpace(button.Label), label) {
+			return button
+		}
+	}
+	return nil
+}
+
+// 解析 /shorten 的结果, 格式如下:
+// **IMPORTANT TOKENS**
+// ~~a~~ **beautiful** painting of ~~a~~ **cat**
+// **SHORTENED OPTIONS**
+// 1️⃣ beautiful painting, cat
+func parseShortenDescription(description string) (tokens []ShortenToken, options []string) {
+	section := ""
+	headerRe := regexp.MustCompile(`^\*{2}(.+?)\*{2}$`)
+	optionRe := regexp.MustCompile(`^\S+\s+(.+)$`)
+	for _, line := range strings.Split(description, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if matches := headerRe.FindStringSubmatch(line); len(matches) > 1 && strings.ToUpper(matches[1]) == matches[1] {
+			section = strings.ToLower(matches[1])
+			continue
+		}
+		switch {
+		case strings.Contains(section, "important tokens"):
+			tokens = append(tokens, parseShortenTokens(line)...)
+		case strings.Contains(section, "shortened options"):
+			if matches := optionRe.FindStringSubmatch(line); len(matches) > 1 {
+				options = append(options, strings.TrimSpace(matches[1]))
+			}
+		}
+	}
+	return
+}
+
+// 加粗的为重要的 token, 删除线的为可以去掉的 token
+func parseShortenTokens(line string) (tokens []ShortenToken) {
+	tokenRe := regexp.MustCompile(`\*{2}(.+?)\*{2}|~~(.+?)~~|([^*~]+)`)
+	for _, matches := range tokenRe.FindAllStringSubmatch(line, -1) {
+		switch {
+		case matches[1] != "":
+			tokens = append(tokens, ShortenToken{Token: strings.TrimSpace(matches[1]), Important: true})
+		case matches[2] != "":
+			tokens = append(tokens, ShortenToken{Token: strings.TrimSpace(matches[2]), Removed: true})
+		default:
+			if token := strings.TrimSpace(matches[3]); token != "" {
+				tokens = append(tokens, ShortenToken{Token: token})
+			}
+		}
+	}
+	return
+}
+
+// 解析 Show Details 中每个 token 的权重, 例如 "cat: 0.52" 或者 "cat (0.52)"
+func parseShortenTokenWeights(text string) map[string]float64 {
+	weights := make(map[string]float64)
+	weightRe := regexp.MustCompile(`^[*_~\x60]*(.+?)[*_~\x60]*\s*(?::|\()\s*([0-9]*\.?[0-9]+)\)?$`)
+	for _, line := range strings.Split(text, "\n") {
+		matches := weightRe.FindStringSubmatch(strings.TrimSpace(line))
+		if len(matches) < 3 {
+			continue
+		}
+		weight, err := strconv.ParseFloat(matches[2], 64)
+		if err != nil {
+			continue
+		}
+		weights[strings.TrimSpace(matches[1])] = weight
+	}
+	return weights
+}
+
+func applyShortenTokenWeights(result *PromptShortenResultPayload, weights map[string]float64) {
+	applied := make(map[string]struct{})
+	for i, token := range result.Tokens {
+		for text, weight := range weights {
+			if strings.EqualFold(text, token.Token) {
+				result.Tokens[i].Weight = weight
+				applied[text] = struct{}{}
+			}
+		}
+	}
+	// 结果中没有出现过的 token 按权重从高到低追加到末尾
+	missing := make([]ShortenToken, 0)
+	for text, weight := range weights {
+		if _, exist := applied[text]; !exist {
+			missing = append(missing, ShortenToken{Token: text, Weight: weight, Important: true})
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].Weight > missing[j].Weight
+	})
+	result.Tokens = append(result.Tokens, missing...)
+}
+
+// 解析 /info 的结果, 每一行的格式为 **Key**: value
+// **Fast Time Remaining**: 3.22/15.0 hours (21.47%)
+// **Lifetime Usage**: 1,234 images (45.67 hours), 数字可能带有千位分隔符
+func parseAccountInfo(description string) (info AccountInfo) {
+	lineRe := regexp.MustCompile(`^\*{2}(.+?)\*{2}:\s*(.*)$`)
+	numberRe := regexp.MustCompile(`[\d,]*\.?\d+`)
+	for _, line := range strings.Split(description, "\n") {
+		matches := lineRe.FindStringSubmatch(strings.TrimSpace(line))
+		if len(matches) < 3 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(matches[1])), strings.TrimSpace(matches[2])
+		numbers := numberRe.FindAllString(value, -1)
+		for i := range numbers {
+			numbers[i] = strings.ReplaceAll(numbers[i], ",", "")
+		}
+		switch {
+		case key == "subscription":
+			info.Subscription = value
+		case key == "job mode":
+			info.JobMode = strings.ToLower(value)
+		case key == "visibility mode":
+			info.VisibilityMode = strings.ToLower(value)
+		case key == "fast time remaining":
+			info.FastTimeRemaining = value
+			if len(numbers) >= 2 {
+				info.FastHoursRemaining, _ = strconv.ParseFloat(numbers[0], 64)
+				info.FastHoursTotal, _ = strconv.ParseFloat(numbers[1], 64)
+			}
+		case key == "lifetime usage":
+			info.LifetimeUsage = value
+			if len(numbers) >= 2 {
+				info.LifetimeImages, _ = strconv.Atoi(numbers[0])
+				info.LifetimeHours, _ = strconv.ParseFloat(numbers[1], 64)
+			}
+		case key == "relaxed usage":
+			info.RelaxedUsage = value
+		case strings.HasPrefix(key, "queued jobs"):
+			count := 0
+			if len(numbers) > 0 {
+				count, _ = strconv.Atoi(numbers[0])
+			}
+			if strings.Contains(key, "relax") {
+				info.QueuedJobsRelax = count
+			} else {
+				info.QueuedJobsFast = count
+			}
+		case key == "running jobs":
+			// 没有任务时为 None, 否则为任务 id 列表
+			if !strings.EqualFold(value, "none") && value != "" {
+				info.RunningJobs = len(strings.FieldsFunc(value, func(r rune) bool {
+					return r == ',' || r == ' '
+				}))
+			}
+		}
+	}
+	return
+}
+
+// 解析 /settings 消息中的组件, 选中的按钮为绿色(SuccessButton), 选择菜单中的默认项为当前版本
+func parseBotSettings(components []discordgo.MessageComponent) (settings BotSettings) {
+	settings.VersionOptions = make([]SettingsVersionOption, 0)
+	settings.Buttons = make([]SettingsButton, 0)
+	for _, component := range flattenComponents(components) {
+		switch c := component.(type) {
+		case *discordgo.SelectMenu:
+			settings.versionMenuId = c.CustomID
+			for _, option := range c.Options {
+				settings.VersionOptions = append(settings.VersionOptions, SettingsVersionOption{Label: option.Label, Value: option.Value})
+				if option.Default {
+					settings.Version = option.Value
+				}
+			}
+		case *discordgo.Button:
+			selected := c.Style == discordgo.SuccessButton
+			settings.Buttons = append(settings.Buttons, SettingsButton{
+				Label:    c.Label,
+				CustomId: c.CustomID,
+				Selected: selected,
+			})
+			if !selected {
+				continue
+			}
+			label := strings.ToLower(strings.TrimSpace(c.Label))
+			switch {
+			case label == "raw mode":
+				settings.RawMode = true
+			case label == "remix mode":
+				settings.RemixMode = true
+			case strings.HasPrefix(label, "stylize "):
+				settings.Stylize = strings.TrimPrefix(label, "stylize ")
+			case label == "public mode":
+				settings.Visibility = "public"
+			case label == "stealth mode":
+				settings.Visibility = "stealth"
+			case strings.HasSuffix(label, " variation mode"):
+				settings.VariationMode = strings.TrimSuffix(label, " variation mode")
+			case label == "fast mode", label == "relax mode", label == "turbo mode":
+				settings.JobMode = strings.TrimSuffix(label, " mode")
+			}
+		}
+	}
+	if settings.Visibility == "" {
+		// 只有 public mode 按钮且未选中时为 stealth
+		for _, button := range settings.Buttons {
+			if strings.EqualFold(button.Label, "public mode") {
+				settings.Visibility = "stealth"
+			}
+		}
+	}
+	return
+}
+
+// 解析生成过程中的消息, 例如 "**prompt** - <@id> (31%) (fast)" 或 "**prompt** - <@id> (Waiting to start)"
+// 没有进度时 progress 为 -1
+func parseProgressMessage(message string) (progress int, status string) {
+	progress = -1
+	index := strings.LastIndex(message, "**")
+	if index == -1 {
+		return
+	}
+	statuses := make([]string, 0)
+	statusRe := regexp.MustCompile(`\(([^()]+)\)`)
+	for _, matches := range statusRe.FindAllStringSubmatch(message[index:], -1) {
+		value := strings.TrimSpace(matches[1])
+		if strings.HasSuffix(value, "%") {
+			if p, err := strconv.Atoi(strings.TrimSuffix(value, "%")); err == nil {
+				progress = p
+			}
+			continue
+		}
+		statuses = append(statuses, value)
+	}
+	status = strings.Join(statuses, " ")
+	return
+}
+
+var zoomParamRegexp = regexp.MustCompile(`\s*--zoom\s+[\d.]+`)
+
+// 去掉 prompt 中原有的 --zoom, 在末尾追加新的倍数
+func setZoomParam(prompt string, zoom float64) string {
+	prompt = strings.TrimSpace(zoomParamRegexp.ReplaceAllString(prompt, ""))
+	return prompt + " --zoom " + strconv.FormatFloat(zoom, 'f', -1, 64)
+}
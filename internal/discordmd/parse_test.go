@@ -0,0 +1,232 @@
+package discordmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestParseAccountInfo(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		want        AccountInfo
+	}{
+		{
+			name: "basic",
+			description: "**User ID**: 123456\n" +
+				"**Subscription**: Standard (Active monthly, renews next on <t:1700000000>)\n" +
+				"**Job Mode**: Fast\n" +
+				"**Visibility Mode**: Public\n" +
+				"**Fast Time Remaining**: 3.22/15.0 hours (21.47%)\n" +
+				"**Lifetime Usage**: 1234 images (45.67 hours)\n" +
+				"**Relaxed Usage**: 12 images (0.5 hours)\n" +
+				"**Queued Jobs (fast)**: 2\n" +
+				"**Queued Jobs (relax)**: 0\n" +
+				"**Running Jobs**: None",
+			want: AccountInfo{
+				Subscription:       "Standard (Active monthly, renews next on <t:1700000000>)",
+				JobMode:            "fast",
+				VisibilityMode:     "public",
+				FastTimeRemaining:  "3.22/15.0 hours (21.47%)",
+				FastHoursRemaining: 3.22,
+				FastHoursTotal:     15,
+				LifetimeUsage:      "1234 images (45.67 hours)",
+				LifetimeImages:     1234,
+				LifetimeHours:      45.67,
+				RelaxedUsage:       "12 images (0.5 hours)",
+				QueuedJobsFast:     2,
+			},
+		},
+		{
+			name: "thousands separator",
+			description: "**Fast Time Remaining**: 1,020.5/1,200.0 hours (85.04%)\n" +
+				"**Lifetime Usage**: 12,345 images (1,234.5 hours)\n" +
+				"**Queued Jobs (relax)**: 1,024",
+			want: AccountInfo{
+				FastTimeRemaining:  "1,020.5/1,200.0 hours (85.04%)",
+				FastHoursRemaining: 1020.5,
+				FastHoursTotal:     1200,
+				LifetimeUsage:      "12,345 images (1,234.5 hours)",
+				LifetimeImages:     12345,
+				LifetimeHours:      1234.5,
+				QueuedJobsRelax:    1024,
+			},
+		},
+		{
+			name:        "running jobs",
+			description: "**Job Mode**: Relaxed\n**Running Jobs**: 0a1b2c, 3d4e5f",
+			want: AccountInfo{
+				JobMode:     "relaxed",
+				RunningJobs: 2,
+			},
+		},
+		{
+			name:        "not an info message",
+			description: "Your subscription has ended",
+			want:        AccountInfo{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseAccountInfo(tt.description); got != tt.want {
+				t.Errorf("parseAccountInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseShortenDescription(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		wantTokens  []ShortenToken
+		wantOptions []string
+	}{
+		{
+			name: "tokens and options",
+			description: "**IMPORTANT TOKENS**\n" +
+				"~~a~~ **beautiful** painting of ~~a~~ **cat**\n" +
+				"\n" +
+				"**SHORTENED OPTIONS**\n" +
+				"1\ufe0f\u20e3 beautiful painting, cat\n" +
+				"2\ufe0f\u20e3 beautiful cat",
+			wantTokens: []ShortenToken{
+				{Token: "a", Removed: true},
+				{Token: "beautiful", Important: true},
+				{Token: "painting of"},
+				{Token: "a", Removed: true},
+				{Token: "cat", Important: true},
+			},
+			wantOptions: []string{"beautiful painting, cat", "beautiful cat"},
+		},
+		{
+			name:        "still processing",
+			description: "**IMPORTANT TOKENS**",
+		},
+		{
+			name:        "bold text that is not a header",
+			description: "**Shortened options** are not ready",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, options := parseShortenDescription(tt.description)
+			if !reflect.DeepEqual(tokens, tt.wantTokens) {
+				t.Errorf("parseShortenDescription() tokens = %+v, want %+v", tokens, tt.wantTokens)
+			}
+			if !reflect.DeepEqual(options, tt.wantOptions) {
+				t.Errorf("parseShortenDescription() options = %q, want %q", options, tt.wantOptions)
+			}
+		})
+	}
+}
+
+func settingsButton(label string, selected bool) *discordgo.Button {
+	style := discordgo.SecondaryButton
+	if selected {
+		style = discordgo.SuccessButton
+	}
+	return &discordgo.Button{Label: label, CustomID: "MJ::Settings::" + label, Style: style}
+}
+
+func TestParseBotSettings(t *testing.T) {
+	versionMenu := &discordgo.SelectMenu{
+		CustomID: "MJ::Settings::VersionSelector",
+		Options: []discordgo.SelectMenuOption{
+			{Label: "Midjourney Model V5.1", Value: "5.1"},
+			{Label: "Midjourney Model V5.2", Value: "5.2", Default: true},
+		},
+	}
+	tests := []struct {
+		name       string
+		components []discordgo.MessageComponent
+		want       BotSettings
+	}{
+		{
+			name: "selected buttons",
+			components: []discordgo.MessageComponent{
+				&discordgo.ActionsRow{Components: []discordgo.MessageComponent{versionMenu}},
+				&discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					settingsButton("RAW Mode", true),
+					settingsButton("Stylize low", false),
+					settingsButton("Stylize med", true),
+				}},
+				&discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					settingsButton("Public mode", false),
+					settingsButton("Remix mode", true),
+					settingsButton("High Variation Mode", false),
+					settingsButton("Low Variation Mode", true),
+				}},
+				&discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					settingsButton("Turbo mode", false),
+					settingsButton("Fast mode", true),
+					settingsButton("Relax mode", false),
+				}},
+			},
+			want: BotSettings{
+				Version:       "5.2",
+				Stylize:       "med",
+				RawMode:       true,
+				RemixMode:     true,
+				Visibility:    "stealth",
+				VariationMode: "low",
+				JobMode:       "fast",
+			},
+		},
+		{
+			name: "public and stealth buttons",
+			components: []discordgo.MessageComponent{
+				&discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					settingsButton("Public mode", true),
+					settingsButton("Stealth mode", false),
+					settingsButton("Relax mode", true),
+				}},
+			},
+			want: BotSettings{
+				Visibility: "public",
+				JobMode:    "relax",
+			},
+		},
+		{
+			name:       "no components",
+			components: nil,
+			want:       BotSettings{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseBotSettings(tt.components)
+			// 按钮与版本选项只是原样记录, 这里只比较解析出来的设置
+			got.VersionOptions, got.Buttons, got.versionMenuId = nil, nil, ""
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBotSettings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBotSettingsVersionMenu(t *testing.T) {
+	settings := parseBotSettings([]discordgo.MessageComponent{
+		&discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			&discordgo.SelectMenu{
+				CustomID: "MJ::Settings::VersionSelector",
+				Options: []discordgo.SelectMenuOption{
+					{Label: "Midjourney Model V5.2", Value: "5.2", Default: true},
+					{Label: "Niji Model V5", Value: "niji5"},
+				},
+			},
+		}},
+	})
+	if settings.versionMenuId != "MJ::Settings::VersionSelector" {
+		t.Errorf("versionMenuId = %q", settings.versionMenuId)
+	}
+	option, found := findVersionOption(settings, "niji5")
+	if !found || option.Label != "Niji Model V5" {
+		t.Errorf("findVersionOption(niji5) = %+v, %t", option, found)
+	}
+	if option, found = findVersionOption(settings, "5.2"); !found || option.Value != "5.2" {
+		t.Errorf("findVersionOption(5.2) = %+v, %t", option, found)
+	}
+}
@@ -0,0 +1,561 @@
+package discordmd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/haojie06/midjourney-http/internal/logger"
+)
+
+// TaskRecord 记录任务的状态与结果, 与 TaskRuntime 不同, 任务结束后仍会保留一段时间以供查询
+type TaskRecord struct {
+	TaskId string `json:"task_id"`
+
+	TaskType MidjourneyTaskType `json:"task_type"`
+
+	ParentTaskId string `json:"parent_task_id"`
+
+	State TaskState `json:"state"`
+
+	Prompt string `json:"prompt"`
+
+	Dimensions string `json:"dimensions,omitempty"` // blend 的尺寸, 例如 --ar 2:3
+
+	BotId string `json:"bot_id"`
+
+	BotUniqueId string `json:"bot_unique_id"`
+
+	APIKeyName string `json:"api_key_name"` // 创建任务的 api key, 用于审计
+
+	UpscaleAPIKeyNames map[string]string `json:"upscale_api_key_names"` // index -> 发起 upscale 的 api key
+
+	SplitAPIKeyName string `json:"split_api_key_name"` // 发起切分的 api key
+
+	Message string `json:"message"`
+
+	Result interface{} `json:"result"`
+
+	Upscales map[string]ImageUpscaleResultPayload `json:"upscales"`
+
+	OriginImageURL string `json:"origin_image_url"`
+
+	OriginImageId string `json:"origin_image_id"`
+
+	OriginImageMessageId string `json:"origin_image_message_id"` // upscale 时需要引用原始消息, 持久化后重启也可以继续 upscale
+
+	UpscaledImages map[string]UpscaledImage `json:"upscaled_images"`
+
+	Progress int `json:"progress"` // 0-100
+
+	ProgressStatus string `json:"progress_status"` // 例如 Waiting to start、fast、relaxed
+
+	PreviewImageURLs []string `json:"preview_image_urls"`
+
+	SplitImageURLs []string `json:"split_image_urls"`
+
+	CreatedAt time.Time `json:"created_at"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+
+	StartedAt *time.Time `json:"started_at"`
+
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+type TaskRegistry struct {
+	records map[string]*TaskRecord
+
+	recordsLock sync.RWMutex
+
+	retention time.Duration // 内存中保留已结束任务的时间, 之后只能从持久化存储中查询
+
+	storeRetention time.Duration // 持久化存储中保留已结束任务的时间, 期间重启后仍然可以 upscale
+
+	lastStorePrune time.Time
+
+	taskTimeout time.Duration // 超过该时间没有更新且未结束的任务视为失败, 0 表示不检查
+
+	store TaskStore // 为 nil 时仅保存在内存中
+
+	subscribers map[string]map[chan TaskEvent]struct{}
+
+	subscribersLock sync.Mutex
+
+	averageTaskDuration time.Duration // 最近任务从开始到结束的平均耗时, 用于估算排队时间
+}
+
+type TaskEventType string
+
+const (
+	TaskEventTypeState    TaskEventType = "state"
+	TaskEventTypeProgress TaskEventType = "progress"
+	TaskEventTypeResult   TaskEventType = "result"
+)
+
+// 任务状态变化时推送给订阅者, 例如 SSE
+type TaskEvent struct {
+	Type TaskEventType `json:"type"`
+
+	TaskId string `json:"task_id"`
+
+	State TaskState `json:"state"`
+
+	Progress int `json:"progress"`
+
+	ProgressStatus string `json:"progress_status"`
+
+	PreviewImageURL string `json:"preview_image_url,omitempty"`
+
+	Message string `json:"message,omitempty"`
+
+	Result interface{} `json:"result,omitempty"`
+
+	Finished bool `json:"finished"` // 为 true 时不会再有新的事件
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewTaskRegistry(retention time.Duration) *TaskRegistry {
+	return &TaskRegistry{
+		records:        make(map[string]*TaskRecord),
+		retention:      retention,
+		storeRetention: 30 * 24 * time.Hour,
+		subscribers:    make(map[string]map[chan TaskEvent]struct{}),
+	}
+}
+
+// 订阅任务事件, 使用完毕后需要调用 cancel, 推送结果事件后 channel 会被关闭
+func (r *TaskRegistry) Subscribe(taskId string) (events chan TaskEvent, cancel func()) {
+	events = make(chan TaskEvent, 16)
+	r.subscribersLock.Lock()
+	defer r.subscribersLock.Unlock()
+	if r.subscribers[taskId] == nil {
+		r.subscribers[taskId] = make(map[chan TaskEvent]struct{})
+	}
+	r.subscribers[taskId][events] = struct{}{}
+	cancel = func() {
+		r.subscribersLock.Lock()
+		defer r.subscribersLock.Unlock()
+		delete(r.subscribers[taskId], events)
+		if len(r.subscribers[taskId]) == 0 {
+			delete(r.subscribers, taskId)
+		}
+	}
+	return
+}
+
+// 根据记录生成事件并推送, 订阅者处理不及时时丢弃进度事件; 结果事件一定送达, 之后关闭订阅的 channel, 调用时需持有 recordsLock
+func (r *TaskRegistry) publish(eventType TaskEventType, record *TaskRecord) {
+	event := TaskEvent{
+		Type:           eventType,
+		TaskId:         record.TaskId,
+		State:          record.State,
+		Progress:       record.Progress,
+		ProgressStatus: record.ProgressStatus,
+		Message:        record.Message,
+		Finished:       record.FinishedAt != nil,
+		CreatedAt:      time.Now(),
+	}
+	if len(record.PreviewImageURLs) > 0 {
+		event.PreviewImageURL = record.PreviewImageURLs[len(record.PreviewImageURLs)-1]
+	}
+	if eventType == TaskEventTypeResult {
+		event.Result = record.Result
+	}
+	r.subscribersLock.Lock()
+	defer r.subscribersLock.Unlock()
+	if eventType != TaskEventTypeResult {
+		for events := range r.subscribers[record.TaskId] {
+			select {
+			case events <- event:
+			default:
+			}
+		}
+		return
+	}
+	for events := range r.subscribers[record.TaskId] {
+		select {
+		case events <- event:
+		default:
+			// 只有这里会写入, 丢弃一个最早的事件后一定有空位
+			select {
+			case <-events:
+			default:
+			}
+			events <- event
+		}
+		close(events)
+	}
+	delete(r.subscribers, record.TaskId)
+}
+
+// 从持久化存储中恢复任务记录, 重启前未结束的任务无法继续, 标记为失败
+func (r *TaskRegistry) Load(store TaskStore) error {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	r.store = store
+	records, err := store.ListTasks()
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(-r.retention)
+	storeDeadline := time.Now().Add(-r.storeRetention)
+	expired := make([]string, 0)
+	for i := range records {
+		record := &records[i]
+		if record.Upscales == nil {
+			record.Upscales = make(map[string]ImageUpscaleResultPayload)
+		}
+		if record.State != TaskStateCompleted && record.State != TaskStateFailed {
+			now := time.Now()
+			record.UpdatedAt = now
+			if record.OriginImageMessageId != "" {
+				// 已经拿到原图, 仍然可以 upscale
+				record.State = TaskStateCompleted
+				record.FinishedAt = &now
+			} else {
+				record.State = TaskStateFailed
+				record.Message = "task interrupted by service restart"
+				record.FinishedAt = &now
+			}
+			r.persist(record)
+		}
+		if record.FinishedAt != nil && record.UpdatedAt.Before(storeDeadline) {
+			expired = append(expired, record.TaskId)
+			continue
+		}
+		// 超过内存保留时间的任务留在持久化存储中, Get 时再读取
+		if record.FinishedAt != nil && record.UpdatedAt.Before(deadline) {
+			continue
+		}
+		r.records[record.TaskId] = record
+	}
+	r.prune(expired)
+	r.lastStorePrune = time.Now()
+	logger.Infof("%d tasks loaded from store, %d tasks in registry", len(records), len(r.records))
+	return nil
+}
+
+// 从持久化存储中删除超过保留时间的任务, 调用时需持有锁
+func (r *TaskRegistry) prune(taskIds []string) {
+	if r.store == nil || len(taskIds) == 0 {
+		return
+	}
+	if err := r.store.DeleteTasks(taskIds); err != nil {
+		logger.Errorf("failed to delete %d expired tasks from store: %s", len(taskIds), err.Error())
+	}
+}
+
+// 关闭持久化存储, 之后的记录只保存在内存中
+func (r *TaskRegistry) Close() error {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	if r.store == nil {
+		return nil
+	}
+	err := r.store.Close()
+	r.store = nil
+	return err
+}
+
+// 写入持久化存储, 调用时需持有锁
+func (r *TaskRegistry) persist(record *TaskRecord) {
+	if r.store == nil {
+		return
+	}
+	if err := r.store.SaveTask(*record); err != nil {
+		logger.Errorf("failed to save task %s to store: %s", record.TaskId, err.Error())
+	}
+}
+
+func (r *TaskRegistry) Add(record *TaskRecord) {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	now := time.Now()
+	record.CreatedAt = now
+	record.UpdatedAt = now
+	if record.State == "" {
+		record.State = TaskStateQueued
+	}
+	if record.Upscales == nil {
+		record.Upscales = make(map[string]ImageUpscaleResultPayload)
+	}
+	r.records[record.TaskId] = record
+	r.persist(record)
+}
+
+// 将持久化存储中的记录重新放回内存, 例如重启后对旧任务进行 upscale
+func (r *TaskRegistry) Restore(record TaskRecord) {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	if _, exist := r.records[record.TaskId]; exist {
+		return
+	}
+	if record.Upscales == nil {
+		record.Upscales = make(map[string]ImageUpscaleResultPayload)
+	}
+	r.records[record.TaskId] = &record
+}
+
+// 返回记录的副本, 避免调用方在锁外读写; 内存中已清理的任务会从持久化存储中查找
+func (r *TaskRegistry) Get(taskId string) (record TaskRecord, exist bool) {
+	r.recordsLock.RLock()
+	defer r.recordsLock.RUnlock()
+	stored, exist := r.records[taskId]
+	if !exist {
+		if r.store == nil {
+			return
+		}
+		var err error
+		if record, exist, err = r.store.GetTask(taskId); err != nil {
+			logger.Errorf("failed to get task %s from store: %s", taskId, err.Error())
+		}
+		return
+	}
+	record = *stored
+	record.PreviewImageURLs = append([]string{}, stored.PreviewImageURLs...)
+	record.SplitImageURLs = append([]string{}, stored.SplitImageURLs...)
+	record.Upscales = make(map[string]ImageUpscaleResultPayload, len(stored.Upscales))
+	for index, upscale := range stored.Upscales {
+		record.Upscales[index] = upscale
+	}
+	record.UpscaleAPIKeyNames = make(map[string]string, len(stored.UpscaleAPIKeyNames))
+	for index, keyName := range stored.UpscaleAPIKeyNames {
+		record.UpscaleAPIKeyNames[index] = keyName
+	}
+	record.UpscaledImages = make(map[string]UpscaledImage, len(stored.UpscaledImages))
+	for index, upscaledImage := range stored.UpscaledImages {
+		record.UpscaledImages[index] = upscaledImage
+	}
+	return
+}
+
+func (r *TaskRegistry) SetState(taskId string, state TaskState) {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	record, exist := r.records[taskId]
+	if !exist {
+		return
+	}
+	now := time.Now()
+	if state == TaskStateRunning && record.StartedAt == nil {
+		record.StartedAt = &now
+	}
+	record.State = state
+	record.UpdatedAt = now
+	r.persist(record)
+	r.publish(TaskEventTypeState, record)
+}
+
+// 进度只保存在内存中, 避免频繁写入存储
+func (r *TaskRegistry) SetProgress(taskId string, progress int, status, previewImageURL string) {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	record, exist := r.records[taskId]
+	if !exist {
+		return
+	}
+	if progress >= 0 {
+		record.Progress = progress
+	}
+	if status != "" {
+		record.ProgressStatus = status
+	}
+	if previewImageURL != "" {
+		record.PreviewImageURLs = append(record.PreviewImageURLs, previewImageURL)
+	}
+	record.UpdatedAt = time.Now()
+	r.publish(TaskEventTypeProgress, record)
+}
+
+func (r *TaskRegistry) SetOriginImage(taskId, url, imageId, messageId string) {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	record, exist := r.records[taskId]
+	if !exist {
+		return
+	}
+	record.OriginImageURL = url
+	record.OriginImageId = imageId
+	record.OriginImageMessageId = messageId
+	record.UpdatedAt = time.Now()
+	r.persist(record)
+}
+
+func (r *TaskRegistry) SetUpscaledImage(taskId, index string, upscaledImage UpscaledImage) {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	record, exist := r.records[taskId]
+	if !exist {
+		return
+	}
+	if record.UpscaledImages == nil {
+		record.UpscaledImages = make(map[string]UpscaledImage)
+	}
+	record.UpscaledImages[index] = upscaledImage
+	record.UpdatedAt = time.Now()
+	r.persist(record)
+}
+
+// 记录发起 upscale 的 api key, 与创建任务的 key 可能不同
+func (r *TaskRegistry) SetUpscaleKeyName(taskId, index, keyName string) {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	record, exist := r.records[taskId]
+	if !exist {
+		return
+	}
+	if record.UpscaleAPIKeyNames == nil {
+		record.UpscaleAPIKeyNames = make(map[string]string)
+	}
+	record.UpscaleAPIKeyNames[index] = keyName
+	record.UpdatedAt = time.Now()
+	r.persist(record)
+}
+
+func (r *TaskRegistry) SetSplitImages(taskId string, imageURLs []string, keyName string) {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	record, exist := r.records[taskId]
+	if !exist {
+		return
+	}
+	record.SplitImageURLs = imageURLs
+	record.SplitAPIKeyName = keyName
+	record.UpdatedAt = time.Now()
+	r.persist(record)
+}
+
+// manual upscale 的结果单独保存, 不会覆盖图片生成的结果, upscale 失败也不影响已经生成的图片
+func (r *TaskRegistry) FinishUpscale(result TaskResult) {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	record, exist := r.records[result.TaskId]
+	if !exist {
+		return
+	}
+	record.UpdatedAt = time.Now()
+	record.Message = result.Message
+	record.State = TaskStateCompleted
+	if upscale, ok := result.Payload.(ImageUpscaleResultPayload); ok && result.Successful {
+		record.Upscales[upscale.Index] = upscale
+	}
+	r.persist(record)
+	r.publish(TaskEventTypeState, record)
+}
+
+// 根据任务结果更新记录
+func (r *TaskRegistry) Finish(result TaskResult) {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	record, exist := r.records[result.TaskId]
+	if !exist {
+		return
+	}
+	now := time.Now()
+	record.UpdatedAt = now
+	record.Message = result.Message
+	record.FinishedAt = &now
+	record.Result = result.Payload
+	if record.StartedAt != nil && result.Successful {
+		r.updateAverageTaskDuration(now.Sub(*record.StartedAt))
+	}
+	if payload, ok := result.Payload.(ImageGenerationResultPayload); ok && len(payload.SplitImageURLs) > 0 {
+		record.SplitImageURLs = payload.SplitImageURLs
+	}
+	if result.Successful {
+		record.State = TaskStateCompleted
+		record.Progress = 100
+	} else {
+		record.State = TaskStateFailed
+	}
+	r.persist(record)
+	r.publish(TaskEventTypeResult, record)
+}
+
+// 指数移动平均, 调用时需持有 recordsLock
+func (r *TaskRegistry) updateAverageTaskDuration(duration time.Duration) {
+	if r.averageTaskDuration == 0 {
+		r.averageTaskDuration = duration
+		return
+	}
+	r.averageTaskDuration = (r.averageTaskDuration*4 + duration) / 5
+}
+
+// 还没有任务完成时返回 1 分钟
+func (r *TaskRegistry) AverageTaskDuration() time.Duration {
+	r.recordsLock.RLock()
+	defer r.recordsLock.RUnlock()
+	if r.averageTaskDuration == 0 {
+		return time.Minute
+	}
+	return r.averageTaskDuration
+}
+
+// 定期从内存中清理已经结束且超过保留时间的任务, 持久化存储中的记录按 storeRetention 单独清理
+func (r *TaskRegistry) StartCleanup(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		r.cleanup()
+	}
+}
+
+func (r *TaskRegistry) cleanup() {
+	r.recordsLock.Lock()
+	defer r.recordsLock.Unlock()
+	now := time.Now()
+	deadline := now.Add(-r.retention)
+	for taskId, record := range r.records {
+		if record.FinishedAt != nil && record.UpdatedAt.Before(deadline) {
+			delete(r.records, taskId)
+			continue
+		}
+		if r.taskTimeout > 0 && now.Sub(record.UpdatedAt) > r.taskTimeout {
+			r.expire(record, now)
+		}
+	}
+	// 需要遍历整个存储, 每小时一次即可
+	if now.Sub(r.lastStorePrune) >= time.Hour {
+		r.lastStorePrune = now
+		r.pruneStore(now.Add(-r.storeRetention))
+	}
+}
+
+// 删除持久化存储中在 deadline 之前结束的任务, 调用时需持有锁
+func (r *TaskRegistry) pruneStore(deadline time.Time) {
+	if r.store == nil {
+		return
+	}
+	records, err := r.store.ListTasks()
+	if err != nil {
+		logger.Errorf("failed to list tasks from store: %s", err.Error())
+		return
+	}
+	expired := make([]string, 0)
+	for _, record := range records {
+		if record.FinishedAt != nil && record.UpdatedAt.Before(deadline) {
+			expired = append(expired, record.TaskId)
+		}
+	}
+	r.prune(expired)
+}
+
+// bot 被移除、连接替换后 runtime 不再存在, 这些任务不会再收到结果, 调用时需持有 recordsLock
+func (r *TaskRegistry) expire(record *TaskRecord, now time.Time) {
+	switch record.State {
+	case TaskStateManualUpscaling:
+		// 与 Finish 一致, upscale 失败不影响已经生成的图片
+		record.State = TaskStateCompleted
+		record.Message = "upscale timeout"
+		record.UpdatedAt = now
+		r.persist(record)
+		r.publish(TaskEventTypeState, record)
+	case TaskStateCreated, TaskStateQueued, TaskStateRunning, TaskStateGetOriginImage, TaskStateAutoUpscaling:
+		record.State = TaskStateFailed
+		record.Message = "task timeout"
+		record.UpdatedAt = now
+		record.FinishedAt = &now
+		r.persist(record)
+		r.publish(TaskEventTypeResult, record)
+	}
+}
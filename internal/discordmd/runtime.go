@@ -1,9 +1,21 @@
 package discordmd
 
-// imagine and describe will create a new TaskRuntime while upscale will reuse.
+import (
+	"strings"
+	"time"
+
+	"github.com/haojie06/midjourney-http/internal/logger"
+	"github.com/haojie06/midjourney-http/internal/storage"
+)
+
+// imagine, describe and variation will create a new TaskRuntime while upscale will reuse.
 type TaskRuntime struct {
 	TaskId string
 
+	ParentTaskId string // variation、reroll 等基于已有任务派生的子任务, 记录父任务
+
+	SourceMessageId string // 子任务点击的按钮所在的消息, 新生成的图片会引用该消息
+
 	TaskKeywordHash string
 
 	InteractionId string // Some command responses will reference the interaction ID that created the command, so we need to keep track of it and use it to find the corresponding TaskRuntime later.
@@ -18,13 +30,49 @@ type TaskRuntime struct {
 
 	UpscaledImageURLs []string
 
+	UpscaledImages map[string]UpscaledImage // index -> upscale 结果, zoom out、pan 等操作需要点击该消息上的按钮
+
+	pendingUpscaleIndexes []string
+
+	upscaleRequestedAt time.Time // 返回结果后再次 upscale 时重新计算超时
+
 	UpscaleProcessCount int
 
 	AutoUpscale bool
 
+	SplitGrid bool // 完成后将四宫格切分为四张图片
+
+	JobMode JobMode // imagine 任务实际使用的模式
+
+	imaginePayload *ImageGenerationTaskPayload // fast 时长用完时以 relax 模式重新提交
+
 	State TaskState
 
+	Progress int // 生成进度, 0-100
+
+	ProgressStatus string // Waiting to start、fast、relaxed 等
+
+	PreviewImageURLs []string // 生成过程中的预览图
+
+	ResponseMessageId string // 指令结果所在的消息, 例如 shorten 的结果
+
+	CreatedAt time.Time
+
+	shortenResult *PromptShortenResultPayload
+
+	shortenDetailsRequested bool
+
+	settingsTask bool
+
+	settingsProfile *BotSettingsProfile // 需要应用的设置, 为空时只读取
+
+	settingsActionCount int
+
+	responded bool // 是否已经返回过结果, manual upscale 会复用 runtime
+
 	taskResultChan chan TaskResult
+
+	registry *TaskRegistry
 }
 
 func NewTaskRuntime(taskId string, autoUpscale bool) *TaskRuntime {
@@ -33,17 +81,184 @@ func NewTaskRuntime(taskId string, autoUpscale bool) *TaskRuntime {
 		TaskKeywordHash:       "", // eg: prompt hash
 		UpscaleResultChannels: make(map[string]chan *ImageUpscaleResultPayload),
 		UpscaledImageURLs:     make([]string, 0),
+		UpscaledImages:        make(map[string]UpscaledImage),
 		taskResultChan:        make(chan TaskResult, 1),
 		AutoUpscale:           autoUpscale,
-		State:                 TaskStateCreated,
+		State:                 TaskStateQueued,
+		CreatedAt:             time.Now(),
+	}
+}
+
+// 指令发送成功后调用, 发送期间不持有 runtimesLock, 结果可能已经先一步返回, 此时不再修改状态
+func (r *TaskRuntime) SetRunning() {
+	if !r.responded {
+		r.SetState(TaskStateRunning)
+	}
+}
+
+func (r *TaskRuntime) SetState(state TaskState) {
+	r.State = state
+	if r.registry != nil {
+		r.registry.SetState(r.TaskId, state)
+	}
+}
+
+func (r *TaskRuntime) SetOriginImage(messageId, url string) {
+	r.OriginImageMessageId = messageId
+	r.OriginImageURL = url
+	r.OriginImageId = getFileIdFromURL(url)
+	if r.registry != nil {
+		r.registry.SetOriginImage(r.TaskId, r.OriginImageURL, r.OriginImageId, r.OriginImageMessageId)
 	}
 }
 
+// progress 小于 0 时只更新状态
+func (r *TaskRuntime) SetProgress(progress int, status, previewImageURL string) {
+	if progress >= 0 {
+		r.Progress = progress
+	}
+	if status != "" {
+		r.ProgressStatus = status
+	}
+	if previewImageURL != "" {
+		r.PreviewImageURLs = append(r.PreviewImageURLs, previewImageURL)
+	}
+	if r.registry != nil {
+		r.registry.SetProgress(r.TaskId, progress, status, previewImageURL)
+	}
+}
+
+// 还在等待结果的任务, 包括已经生成原图但仍在 upscale 的任务
+func (r *TaskRuntime) InFlight() bool {
+	return !r.responded || len(r.pendingUpscaleIndexes) > 0
+}
+
+// 超过 timeout 仍在等待结果, 已经返回过结果的任务从最近一次 upscale 开始计算
+func (r *TaskRuntime) Expired(timeout time.Duration) bool {
+	if !r.InFlight() {
+		return false
+	}
+	since := r.CreatedAt
+	if r.responded {
+		since = r.upscaleRequestedAt
+	}
+	return time.Since(since) > timeout
+}
+
+// 记录已经发出的 upscale 请求
+func (r *TaskRuntime) AddPendingUpscale(index string) {
+	if len(r.pendingUpscaleIndexes) == 0 {
+		r.upscaleRequestedAt = time.Now()
+	}
+	r.pendingUpscaleIndexes = append(r.pendingUpscaleIndexes, index)
+}
+
+// 记录 upscale 结果所在的消息, 部分版本的结果消息中不包含 index, 此时按照请求顺序对应
+func (r *TaskRuntime) SetUpscaledImage(index, messageId, imageURL string) string {
+	pendingIndex := -1
+	for i, pending := range r.pendingUpscaleIndexes {
+		if pending == index || index == "" {
+			pendingIndex = i
+			break
+		}
+	}
+	if pendingIndex != -1 {
+		index = r.pendingUpscaleIndexes[pendingIndex]
+		r.pendingUpscaleIndexes = append(r.pendingUpscaleIndexes[:pendingIndex], r.pendingUpscaleIndexes[pendingIndex+1:]...)
+	}
+	if index == "" {
+		return index
+	}
+	upscaledImage := UpscaledImage{
+		MessageId: messageId,
+		ImageId:   getFileIdFromURL(imageURL),
+		ImageURL:  imageURL,
+	}
+	r.UpscaledImages[index] = upscaledImage
+	if r.registry != nil {
+		r.registry.SetUpscaledImage(r.TaskId, index, upscaledImage)
+	}
+	return index
+}
+
 func (r *TaskRuntime) Response(successful bool, message string, payload interface{}) {
-	r.taskResultChan <- TaskResult{
+	result := TaskResult{
 		TaskId:     r.TaskId,
 		Successful: successful,
 		Message:    message,
 		Payload:    payload,
 	}
+	r.responded = true
+	// 在持有 runtimesLock 时确定结果的类型, 转存期间 runtime 可能已经开始下一次 upscale
+	manualUpscale := r.State == TaskStateManualUpscaling
+	if successful && storage.MirrorApp.Enabled() {
+		// 下载图片较慢, 不阻塞 bot 的事件处理
+		splitGrid := r.SplitGrid
+		go func() {
+			r.respond(mirrorResultImages(result, splitGrid), manualUpscale)
+		}()
+		return
+	}
+	r.respond(result, manualUpscale)
+}
+
+func (r *TaskRuntime) respond(result TaskResult, manualUpscale bool) {
+	if r.registry != nil {
+		if manualUpscale {
+			r.registry.FinishUpscale(result)
+		} else {
+			r.registry.Finish(result)
+		}
+	}
+	// 调用方可能持有 runtimesLock, 不能阻塞; 复用的 runtime 上一次的结果没人读取时替换成新的结果
+	for {
+		select {
+		case r.taskResultChan <- result:
+			return
+		default:
+		}
+		select {
+		case <-r.taskResultChan:
+			logger.Warnf("previous result of task %s is not received, replaced", r.TaskId)
+		default:
+		}
+	}
+}
+
+// 转存结果中的图片, 失败时只保留 discord 的地址
+func mirrorResultImages(result TaskResult, splitGrid bool) TaskResult {
+	mirror := func(imageURL string) string {
+		if imageURL == "" {
+			return ""
+		}
+		mirroredURL, err := storage.MirrorApp.MirrorImage(result.TaskId, imageURL)
+		if err != nil {
+			logger.Warnf("task %s failed to mirror image %s: %s", result.TaskId, imageURL, err.Error())
+		}
+		return mirroredURL
+	}
+	switch payload := result.Payload.(type) {
+	case ImageGenerationResultPayload:
+		if splitGrid && payload.OriginImageURL != "" {
+			// 转存和切分共用一次下载
+			mirroredURL, splitImageURLs, err := storage.MirrorApp.MirrorGrid(result.TaskId, payload.OriginImageURL)
+			if err != nil {
+				logger.Warnf("task %s failed to split grid: %s", result.TaskId, err.Error())
+				result.Message = strings.TrimSpace(result.Message + " failed to split grid: " + err.Error())
+			}
+			payload.MirroredOriginImageURL = mirroredURL
+			payload.SplitImageURLs = splitImageURLs
+		} else {
+			payload.MirroredOriginImageURL = mirror(payload.OriginImageURL)
+		}
+		payload.MirroredImageURLs = make([]string, 0, len(payload.ImageURLs))
+		for _, imageURL := range payload.ImageURLs {
+			payload.MirroredImageURLs = append(payload.MirroredImageURLs, mirror(imageURL))
+		}
+		result.Payload = payload
+	case ImageUpscaleResultPayload:
+		payload.MirroredImageURL = mirror(payload.ImageURL)
+		result.Payload = payload
+	}
+	return result
 }
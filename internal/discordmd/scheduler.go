@@ -0,0 +1,109 @@
+package discordmd
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type SchedulerStrategy string
+
+const (
+	SchedulerStrategyRandom             SchedulerStrategy = "random"
+	SchedulerStrategyLeastLoaded        SchedulerStrategy = "least_loaded"
+	SchedulerStrategyWeightedRoundRobin SchedulerStrategy = "weighted_round_robin"
+	SchedulerStrategyFastHours          SchedulerStrategy = "fast_hours"
+)
+
+// Scheduler 为新任务选择 bot, upscale 等基于已有任务的操作不经过调度, 始终使用原来的 bot
+type Scheduler interface {
+	Pick(bots []*DiscordBot) *DiscordBot
+}
+
+func NewScheduler(strategy SchedulerStrategy) (Scheduler, error) {
+	switch strategy {
+	case SchedulerStrategyRandom:
+		return &RandomScheduler{randGenerator: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	case "", SchedulerStrategyLeastLoaded:
+		return &LeastLoadedScheduler{}, nil
+	case SchedulerStrategyWeightedRoundRobin:
+		return &WeightedRoundRobinScheduler{currentWeights: make(map[string]int)}, nil
+	case SchedulerStrategyFastHours:
+		return &FastHoursScheduler{fallback: &LeastLoadedScheduler{}}, nil
+	}
+	return nil, fmt.Errorf("unknown scheduler strategy: %s", strategy)
+}
+
+type RandomScheduler struct {
+	randGenerator *rand.Rand
+
+	lock sync.Mutex
+}
+
+func (s *RandomScheduler) Pick(bots []*DiscordBot) *DiscordBot {
+	if len(bots) == 0 {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return bots[s.randGenerator.Intn(len(bots))]
+}
+
+// 选择未完成任务最少的 bot
+type LeastLoadedScheduler struct{}
+
+func (s *LeastLoadedScheduler) Pick(bots []*DiscordBot) (picked *DiscordBot) {
+	minTasks := 0
+	for _, bot := range bots {
+		inFlight := bot.InFlightTasks()
+		if picked == nil || inFlight < minTasks {
+			picked = bot
+			minTasks = inFlight
+		}
+	}
+	return
+}
+
+// 平滑加权轮询, 权重来自配置中的 weight
+type WeightedRoundRobinScheduler struct {
+	currentWeights map[string]int
+
+	lock sync.Mutex
+}
+
+func (s *WeightedRoundRobinScheduler) Pick(bots []*DiscordBot) (picked *DiscordBot) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	totalWeight := 0
+	for _, bot := range bots {
+		weight := bot.Weight()
+		totalWeight += weight
+		s.currentWeights[bot.UniqueId] += weight
+		if picked == nil || s.currentWeights[bot.UniqueId] > s.currentWeights[picked.UniqueId] {
+			picked = bot
+		}
+	}
+	if picked != nil {
+		s.currentWeights[picked.UniqueId] -= totalWeight
+	}
+	return
+}
+
+// 优先选择还有 fast 时长的账号, 都没有(或者还没有获取到账号信息)时退回到 fallback
+type FastHoursScheduler struct {
+	fallback Scheduler
+}
+
+func (s *FastHoursScheduler) Pick(bots []*DiscordBot) *DiscordBot {
+	candidates := make([]*DiscordBot, 0, len(bots))
+	for _, bot := range bots {
+		if info, exist := bot.GetAccountInfo(); exist && info.FastHoursRemaining > 0 {
+			candidates = append(candidates, bot)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = bots
+	}
+	return s.fallback.Pick(candidates)
+}
@@ -3,7 +3,9 @@ package discordmd
 import (
 	"fmt"
 	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/haojie06/midjourney-http/internal/logger"
@@ -17,7 +19,26 @@ var (
 	ErrFailedToCreateTask              = fmt.Errorf("failed to create task")
 	ErrFailedToDescribeImage           = fmt.Errorf("failed to describe image")
 	ErrBotNotFound                     = fmt.Errorf("bot not found")
+	ErrNoHealthyBot                    = fmt.Errorf("no healthy bot available, bots may be quarantined, disabled or in maintenance")
+	ErrServiceInMaintenance            = fmt.Errorf("service is in maintenance mode, new tasks are not accepted")
+	ErrAllBotsInMaintenance            = fmt.Errorf("all bots are in maintenance mode, new tasks are not accepted")
+	ErrBotDisabled                     = fmt.Errorf("bot is disabled")
+	ErrBotExists                       = fmt.Errorf("bot already exists")
+	ErrInvalidBotConfig                = fmt.Errorf("unique_id, discord_token, discord_app_id and discord_channel_id are required")
 	ErrCommandNotFound                 = fmt.Errorf("command not found")
+	ErrBotClosed                       = fmt.Errorf("bot is closed")
+	ErrInvalidImageIndex               = fmt.Errorf("invalid image index, should be 1-4")
+	ErrOriginImageNotReady             = fmt.Errorf("origin image is not ready")
+	ErrUpscaledImageNotFound           = fmt.Errorf("upscaled image not found, upscale the image first")
+	ErrInvalidOutpaintAction           = fmt.Errorf("invalid outpaint action")
+	ErrInvalidCustomZoom               = fmt.Errorf("invalid custom zoom, should be greater than 1 and at most 2")
+	ErrModalNotReceived                = fmt.Errorf("modal is not received")
+	ErrInvalidBlendImages              = fmt.Errorf("blend requires 2-5 images")
+	ErrFailedToGetAccountInfo          = fmt.Errorf("failed to get account info")
+	ErrFailedToGetSettings             = fmt.Errorf("failed to get settings")
+	ErrInvalidSettingsProfile          = fmt.Errorf("invalid settings, stylize should be low, med, high or very high, visibility should be public or stealth, variation mode should be high or low")
+	ErrInvalidBlendDimensions          = fmt.Errorf("invalid blend dimensions, should be portrait, square or landscape")
+	ErrInvalidJobMode                  = fmt.Errorf("invalid job mode, should be fast, relax or turbo")
 	FailedEmbededMessageTitlesInCreate = map[string]struct{}{
 		"Pending mod message":                {},
 		"Blocked":                            {},
@@ -31,6 +52,9 @@ var (
 		"Action required to continue":        {},
 		"Job action restricted":              {},
 		"Empty prompt":                       {},
+		"Fast hours exhausted":               {},
+		"Out of fast hours":                  {},
+		"You have run out of fast hours":     {},
 	}
 	FailedEmbededMessageTitlesInUpdate = map[string]struct{}{
 		"Request cancelled due to image filters": {},
@@ -38,11 +62,24 @@ var (
 )
 
 func init() {
+	taskRegistry := NewTaskRegistry(24 * time.Hour)
 	MidJourneyServiceApp = &MidJourneyService{
 		discordBots:   make(map[string]*DiscordBot),
 		taskIdToBotId: sync.Map{},
+		removedBots:   make(map[string]bool),
 		botMapMutex:   sync.Mutex{},
 		randGenerator: rand.New(rand.NewSource(time.Now().UnixNano())),
+		taskRegistry:  taskRegistry,
+		scheduler:     &LeastLoadedScheduler{},
+
+		accountInfoRefreshInterval: 10 * time.Minute,
+		healthCheckInterval:        time.Minute,
+		drainTimeout:               30 * time.Minute,
+		taskTimeout:                60 * time.Minute,
+	}
+	MidJourneyServiceApp.admission = &AdmissionController{
+		bots:     MidJourneyServiceApp.listBots,
+		registry: taskRegistry,
 	}
 }
 
@@ -52,38 +89,201 @@ type MidJourneyService struct {
 	discordBots   map[string]*DiscordBot
 	botMapMutex   sync.Mutex
 	randGenerator *rand.Rand
+	randLock      sync.Mutex // 保护 randGenerator
+	taskRegistry  *TaskRegistry
+	scheduler     Scheduler
+	admission     *AdmissionController
+
+	accountInfoRefreshInterval time.Duration
+
+	healthCheckInterval time.Duration
+
+	quarantineFailures int
+
+	quarantineDuration time.Duration
+
+	drainTimeout time.Duration // 移除 bot 时等待任务结束的最长时间
+
+	taskTimeout time.Duration // 任务等待结果的最长时间
+
+	reloadLock sync.Mutex // 调整 bot 列表时持有
+
+	removedBots map[string]bool // 通过接口移除的配置文件中的 bot, 重新加载配置时不再添加
+
+	maintenance atomic.Bool // 全局维护模式, 拒绝新任务, 已有任务的 upscale 等操作不受影响
 }
 
-func (m *MidJourneyService) Start(botConfigs []DiscordBotConfig) {
-	for _, botConfig := range botConfigs {
-		bot, err := NewDiscordBot(botConfig)
+func (m *MidJourneyService) Start(config ServiceConfig, botConfigs []DiscordBotConfig) {
+	if config.TaskRetention > 0 {
+		m.taskRegistry.retention = config.TaskRetention
+	}
+	if config.TaskStoreRetention > 0 {
+		m.taskRegistry.storeRetention = config.TaskStoreRetention
+	}
+	if m.taskRegistry.storeRetention < m.taskRegistry.retention {
+		m.taskRegistry.storeRetention = m.taskRegistry.retention
+	}
+	if config.StorePath != "" {
+		store, err := NewBoltTaskStore(config.StorePath)
 		if err != nil {
+			logger.Errorf("failed to open task store, err: %s", err)
+		} else if err := m.taskRegistry.Load(store); err != nil {
+			logger.Errorf("failed to load tasks from store, err: %s", err)
+		}
+	}
+	m.admission.maxInFlightTasks = config.MaxInFlightTasks
+	m.admission.maxQueuedTasks = config.MaxQueuedTasks
+	if scheduler, err := NewScheduler(config.Scheduler); err != nil {
+		logger.Errorf("%s, fallback to %s", err, SchedulerStrategyLeastLoaded)
+	} else {
+		m.scheduler = scheduler
+	}
+	if config.AccountInfoRefreshInterval > 0 {
+		m.accountInfoRefreshInterval = config.AccountInfoRefreshInterval
+	}
+	if config.HealthCheckInterval > 0 {
+		m.healthCheckInterval = config.HealthCheckInterval
+	}
+	m.quarantineFailures = config.QuarantineFailures
+	m.quarantineDuration = config.QuarantineDuration
+	if config.DrainTimeout > 0 {
+		m.drainTimeout = config.DrainTimeout
+	}
+	if config.TaskTimeout > 0 {
+		m.taskTimeout = config.TaskTimeout
+	}
+	// bot 会先让超时的任务失败, 这里兜底处理 runtime 已经不存在的任务
+	m.taskRegistry.taskTimeout = m.taskTimeout + m.healthCheckInterval
+	go m.taskRegistry.StartCleanup(time.Minute)
+	m.reloadLock.Lock()
+	for _, botConfig := range botConfigs {
+		if _, err := m.addBot(botConfig, true); err != nil {
 			logger.Errorf("failed to create discord bot, err: %s", err)
-			continue
 		}
-		m.discordBots[bot.BotId] = bot
-		go bot.Start()
+	}
+	m.reloadLock.Unlock()
+	go m.startAccountInfoRefresh()
+	go m.startHealthCheck()
+}
+
+// 退出前断开所有 bot 并关闭任务存储, 保证 bbolt 的数据写入磁盘
+func (m *MidJourneyService) Close() {
+	for _, bot := range m.listBots() {
+		bot.Close()
+	}
+	if err := m.taskRegistry.Close(); err != nil {
+		logger.Errorf("failed to close task store, err: %s", err)
 	}
 }
 
-// get a random bot
+// 已有任务返回原来的 bot, 新任务由调度器选择
 func (m *MidJourneyService) GetBot(taskId string) (bot *DiscordBot, err error) {
+	return m.getBot(taskId, "")
+}
+
+// mode 为新任务指定的模式, fast、turbo 任务优先分配给还有 fast 时长的 bot
+func (m *MidJourneyService) getBot(taskId string, mode JobMode) (bot *DiscordBot, err error) {
 	m.botMapMutex.Lock()
 	defer m.botMapMutex.Unlock()
 
 	botId, exist := m.taskIdToBotId.Load(taskId)
 	if !exist {
-		keys := make([]string, 0, len(m.discordBots))
-		for k := range m.discordBots {
-			keys = append(keys, k)
+		// 重启后 botId 会变化, 通过持久化的 uniqueId 找回原来的 bot
+		if record, recorded := m.taskRegistry.Get(taskId); recorded && record.BotUniqueId != "" {
+			if bot = m.getBotByUniqueId(record.BotUniqueId); bot == nil {
+				err = ErrBotNotFound
+				return
+			}
+			m.taskIdToBotId.Store(taskId, bot.BotId)
+			return
+		}
+		if m.maintenance.Load() {
+			err = ErrServiceInMaintenance
+			return
+		}
+		// 新任务交给调度器选择, 隔离或断开的 bot 不参与调度
+		bots := make([]*DiscordBot, 0, len(m.discordBots))
+		for _, bot := range m.discordBots {
+			bots = append(bots, bot)
+		}
+		bots = preferFastHoursBots(filterSchedulableBots(bots), mode)
+		sort.Slice(bots, func(i, j int) bool {
+			return bots[i].UniqueId < bots[j].UniqueId
+		})
+		if bot = m.scheduler.Pick(bots); bot == nil {
+			err = ErrNoHealthyBot
+			if allBotsInMaintenance(m.discordBots) {
+				err = ErrAllBotsInMaintenance
+			}
+			return
 		}
-		randomKey := keys[rand.Intn(len(keys))]
-		bot = m.discordBots[randomKey]
 		m.taskIdToBotId.Store(taskId, bot.BotId)
-	} else {
-		if bot, exist = m.discordBots[botId.(string)]; !exist {
+	} else if bot, exist = m.discordBots[botId.(string)]; !exist {
+		// 原来的 bot 已经被移除或替换, 通过 uniqueId 找到新的 bot
+		if record, recorded := m.taskRegistry.Get(taskId); recorded && record.BotUniqueId != "" {
+			bot = m.getBotByUniqueId(record.BotUniqueId)
+		}
+		if bot == nil {
 			err = ErrBotNotFound
+			return
+		}
+		m.taskIdToBotId.Store(taskId, bot.BotId)
+	}
+	if bot != nil && !bot.Enabled() {
+		bot = nil
+		err = ErrBotDisabled
+	}
+	return
+}
+
+func (m *MidJourneyService) listBots() []*DiscordBot {
+	m.botMapMutex.Lock()
+	defer m.botMapMutex.Unlock()
+	bots := make([]*DiscordBot, 0, len(m.discordBots))
+	for _, bot := range m.discordBots {
+		bots = append(bots, bot)
+	}
+	return bots
+}
+
+// 新任务分配到 bot 之后检查并发上限, 被拒绝的任务不再绑定到该 bot; 写入 runtime 后调用 release
+func (m *MidJourneyService) admit(taskId string, bot *DiscordBot) (release func(), err error) {
+	if release, err = m.admission.Admit(bot); err != nil {
+		m.taskIdToBotId.Delete(taskId)
+	}
+	return
+}
+
+// 全局排队中的任务数量
+func (m *MidJourneyService) QueueDepth() int {
+	return m.admission.QueueDepth()
+}
+
+// 任务在所属 bot 队列中的位置, 已经开始执行或者不存在时返回 0
+func (m *MidJourneyService) QueuePosition(taskId string) int {
+	botId, exist := m.taskIdToBotId.Load(taskId)
+	if !exist {
+		return 0
+	}
+	m.botMapMutex.Lock()
+	bot, exist := m.discordBots[botId.(string)]
+	m.botMapMutex.Unlock()
+	if !exist {
+		return 0
+	}
+	return bot.taskQueue.Position(taskId)
+}
+
+// 调用时需持有 botMapMutex, 替换过程中新旧 bot 同时存在, 优先返回新的 bot
+func (m *MidJourneyService) getBotByUniqueId(uniqueId string) (found *DiscordBot) {
+	for _, bot := range m.discordBots {
+		if bot.UniqueId != uniqueId {
+			continue
+		}
+		if !bot.Retired() {
+			return bot
 		}
+		found = bot
 	}
 	return
 }
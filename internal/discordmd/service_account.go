@@ -0,0 +1,79 @@
+package discordmd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/haojie06/midjourney-http/internal/logger"
+)
+
+// 获取账号信息, 缓存超过刷新间隔或者 refresh 为 true 时重新执行 /info
+func (m *MidJourneyService) GetAccountInfo(uniqueId string, refresh bool) (info AccountInfo, err error) {
+	m.botMapMutex.Lock()
+	bot := m.getBotByUniqueId(uniqueId)
+	m.botMapMutex.Unlock()
+	if bot == nil {
+		err = ErrBotNotFound
+		return
+	}
+	info, exist := bot.GetAccountInfo()
+	if exist && !refresh && time.Since(info.UpdatedAt) < m.accountInfoRefreshInterval {
+		return
+	}
+	return m.refreshAccountInfo(bot)
+}
+
+func (m *MidJourneyService) refreshAccountInfo(bot *DiscordBot) (info AccountInfo, err error) {
+	taskId := uuid.New().String()
+	bot.runtimesLock.Lock()
+	taskRuntime := NewTaskRuntime(taskId, false)
+	taskResultChan := taskRuntime.taskResultChan
+	bot.taskRuntimes[taskId] = taskRuntime
+	bot.taskQueue.Push(&MidjourneyTask{
+		TaskId:   taskId,
+		TaskType: MidjourneyTaskTypeAccountInfo,
+	})
+	bot.runtimesLock.Unlock()
+
+	select {
+	case result := <-taskResultChan:
+		if !result.Successful {
+			err = ErrFailedToGetAccountInfo
+			return
+		}
+		info, _ = result.Payload.(AccountInfo)
+		return
+	case <-time.After(3 * time.Minute):
+		bot.runtimesLock.Lock()
+		bot.RemoveTaskRuntime(taskId)
+		bot.runtimesLock.Unlock()
+		err = ErrFailedToGetAccountInfo
+		return
+	}
+}
+
+// 定期刷新所有 bot 的账号信息, 供调度以及监控使用
+func (m *MidJourneyService) startAccountInfoRefresh() {
+	for {
+		m.botMapMutex.Lock()
+		bots := make([]*DiscordBot, 0, len(m.discordBots))
+		for _, bot := range m.discordBots {
+			bots = append(bots, bot)
+		}
+		m.botMapMutex.Unlock()
+		// 每个 bot 的 /info 需要等待回复, 同时刷新, 避免一个 bot 超时拖慢其他 bot
+		var wg sync.WaitGroup
+		for _, bot := range bots {
+			wg.Add(1)
+			go func(bot *DiscordBot) {
+				defer wg.Done()
+				if _, err := m.refreshAccountInfo(bot); err != nil {
+					logger.Warnf("failed to refresh account info of bot %s, err: %s", bot.UniqueId, err)
+				}
+			}(bot)
+		}
+		wg.Wait()
+		time.Sleep(m.accountInfoRefreshInterval)
+	}
+}
@@ -0,0 +1,40 @@
+package discordmd
+
+import (
+	"time"
+
+	"github.com/haojie06/midjourney-http/internal/logger"
+)
+
+// 定期检查 bot 的健康状态, 断开过久的 bot 重新连接, 隔离到期的 bot 通过 /info 探测, 同时清理超时的任务
+func (m *MidJourneyService) startHealthCheck() {
+	probing := make(map[string]bool)
+	probeDone := make(chan string)
+	ticker := time.NewTicker(m.healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case uniqueId := <-probeDone:
+			delete(probing, uniqueId)
+			continue
+		case <-ticker.C:
+		}
+		for _, bot := range m.listBots() {
+			bot.failExpiredTasks()
+			if bot.needsReconnect(m.healthCheckInterval) {
+				if err := bot.reconnect(); err != nil {
+					logger.Warnf("failed to reconnect bot %s, err: %s", bot.UniqueId, err)
+				}
+				continue
+			}
+			if bot.needsProbe() && !probing[bot.UniqueId] {
+				probing[bot.UniqueId] = true
+				go func(bot *DiscordBot) {
+					_, err := m.refreshAccountInfo(bot)
+					bot.health.recordProbe(err)
+					probeDone <- bot.UniqueId
+				}(bot)
+			}
+		}
+	}
+}
@@ -9,14 +9,24 @@ import (
 	"strings"
 
 	"github.com/google/uuid"
+	"github.com/haojie06/midjourney-http/internal/storage"
 )
 
 // imagine a image (create a task)
-func (m *MidJourneyService) Imagine(prompt, params string, fastMode, autoUpscale bool) (taskId string, taskResultChan chan TaskResult, err error) {
+// splitGrid 为 true 时不会自动 upscale, 而是在服务端切分四宫格
+// mode 为空时使用 bot 配置的默认模式
+func (m *MidJourneyService) Imagine(prompt, params string, mode JobMode, autoUpscale, splitGrid bool, priority int, keyName string) (taskId string, taskResultChan chan TaskResult, err error) {
 	// allocate taskId from prompt
 	taskId = uuid.New().String()
+	if splitGrid {
+		if !storage.MirrorApp.Enabled() {
+			err = storage.ErrStorageNotConfigured
+			return
+		}
+		autoUpscale = false
+	}
 
-	seed := strconv.Itoa(m.randGenerator.Intn(math.MaxUint32))
+	seed := m.newSeed()
 	params += " --seed " + seed
 	// remove extra spaces
 	prompt = strings.Join(strings.Fields(strings.Trim(strings.Trim(prompt, " ")+" "+params, " ")), " ")
@@ -25,42 +35,100 @@ func (m *MidJourneyService) Imagine(prompt, params string, fastMode, autoUpscale
 	// use hash for taskId
 	taskKeywordHash := getHashFromPrompt(prompt, seed)
 
-	bot, err := m.GetBot(taskId)
+	bot, err := m.getBot(taskId, mode)
+	if err != nil {
+		return
+	}
+	release, err := m.admit(taskId, bot)
 	if err != nil {
 		return
 	}
+	defer release()
 
 	bot.runtimesLock.Lock()
 	defer bot.runtimesLock.Unlock()
 
-	taskResultChan = make(chan TaskResult, 1)
-	bot.taskRuntimes[taskId] = &TaskRuntime{
-		TaskId:                taskId,
-		TaskKeywordHash:       taskKeywordHash, // 部分交互的回复，不引用interaction, 因此需要通过关键词来关联
-		UpscaleResultChannels: make(map[string]chan *ImageUpscaleResultPayload),
-		UpscaledImageURLs:     make([]string, 0),
-		taskResultChan:        taskResultChan,
-		AutoUpscale:           autoUpscale,
-		State:                 TaskStateCreated,
-	}
+	taskRuntime := NewTaskRuntime(taskId, autoUpscale)
+	taskRuntime.TaskKeywordHash = taskKeywordHash // 部分交互的回复，不引用interaction, 因此需要通过关键词来关联
+	taskRuntime.SplitGrid = splitGrid
+	taskRuntime.registry = m.taskRegistry
+	taskResultChan = taskRuntime.taskResultChan
+	bot.taskRuntimes[taskId] = taskRuntime
+	m.taskRegistry.Add(&TaskRecord{
+		TaskId:      taskId,
+		TaskType:    MidjourneyTaskTypeImageGeneration,
+		Prompt:      prompt,
+		BotId:       bot.BotId,
+		BotUniqueId: bot.UniqueId,
+		APIKeyName:  keyName,
+	})
 	// TODO 改为不需要marshal
 	payload, _ := json.Marshal(ImageGenerationTaskPayload{
 		Prompt:      prompt,
-		FastMode:    fastMode,
+		Mode:        mode,
 		AutoUpscale: autoUpscale,
 	})
 	// send task
-	bot.taskChan <- &MidjourneyTask{
+	bot.taskQueue.Push(&MidjourneyTask{
 		TaskId:   taskId,
 		TaskType: MidjourneyTaskTypeImageGeneration,
 		Payload:  payload,
+		Priority: priority,
+	})
+	return
+}
+
+// 查询任务状态, 包括排队中、运行中以及已经结束(保留期内)的任务
+// randGenerator 不是并发安全的, 多个请求同时创建任务时需要加锁
+func (m *MidJourneyService) newSeed() string {
+	m.randLock.Lock()
+	defer m.randLock.Unlock()
+	return strconv.Itoa(m.randGenerator.Intn(math.MaxUint32))
+}
+
+func (m *MidJourneyService) GetTask(taskId string) (record TaskRecord, err error) {
+	record, exist := m.taskRegistry.Get(taskId)
+	if !exist {
+		err = ErrTaskNotFound
+	}
+	return
+}
+
+// 订阅任务事件, 先订阅再读取记录, 避免错过两者之间的事件
+func (m *MidJourneyService) SubscribeTask(taskId string) (record TaskRecord, events chan TaskEvent, cancel func(), err error) {
+	events, cancel = m.taskRegistry.Subscribe(taskId)
+	record, exist := m.taskRegistry.Get(taskId)
+	if !exist {
+		cancel()
+		err = ErrTaskNotFound
+	}
+	return
+}
+
+// 切分已完成任务的四宫格, 结果会记录在任务中, 重复调用直接返回
+func (m *MidJourneyService) SplitGrid(taskId, keyName string) (imageURLs []string, err error) {
+	record, exist := m.taskRegistry.Get(taskId)
+	if !exist {
+		err = ErrTaskNotFound
+		return
+	}
+	if len(record.SplitImageURLs) > 0 {
+		return record.SplitImageURLs, nil
+	}
+	if record.OriginImageURL == "" {
+		err = ErrOriginImageNotReady
+		return
 	}
+	if imageURLs, err = storage.MirrorApp.SplitGrid(taskId, record.OriginImageURL); err != nil {
+		return
+	}
+	m.taskRegistry.SetSplitImages(taskId, imageURLs, keyName)
 	return
 }
 
 // Upscale a image with given taskId and index
 // upscale 基于已有的 图片生成任务进行，所以需要传入 taskId 和 index
-func (m *MidJourneyService) Upscale(taskId, index string) (taskResultChan chan TaskResult, err error) {
+func (m *MidJourneyService) Upscale(taskId, index string, priority int, keyName string) (taskResultChan chan TaskResult, err error) {
 	bot, err := m.GetBot(taskId)
 	if err != nil {
 		return
@@ -70,10 +138,15 @@ func (m *MidJourneyService) Upscale(taskId, index string) (taskResultChan chan T
 	defer bot.runtimesLock.Unlock()
 	taskRuntime, exist := bot.taskRuntimes[taskId]
 	if !exist {
-		err = ErrTaskNotFound
-		return
+		// runtime 在任务结束或重启后会被移除, 从任务记录中恢复
+		if taskRuntime = m.restoreTaskRuntime(taskId); taskRuntime == nil {
+			err = ErrTaskNotFound
+			return
+		}
+		bot.taskRuntimes[taskId] = taskRuntime
 	}
-	taskRuntime.State = TaskStateManualUpscaling
+	taskRuntime.SetState(TaskStateManualUpscaling)
+	m.taskRegistry.SetUpscaleKeyName(taskId, index, keyName)
 	taskResultChan = taskRuntime.taskResultChan
 
 	payload, _ := json.Marshal(ImageUpscaleTaskPayload{
@@ -81,34 +154,289 @@ func (m *MidJourneyService) Upscale(taskId, index string) (taskResultChan chan T
 		Index:                index,
 		OriginImageMessageId: taskRuntime.OriginImageMessageId,
 	})
-	bot.taskChan <- &MidjourneyTask{
+	bot.taskQueue.Push(&MidjourneyTask{
 		TaskId:   taskId,
 		TaskType: MidjourneyTaskTypeImageUpscale,
 		Payload:  payload,
+		Priority: priority,
+	})
+	return
+}
+
+// 根据任务记录重建 runtime, 只有已经拿到原图的任务才能恢复
+func (m *MidJourneyService) restoreTaskRuntime(taskId string) *TaskRuntime {
+	record, exist := m.taskRegistry.Get(taskId)
+	if !exist || record.OriginImageMessageId == "" {
+		return nil
+	}
+	m.taskRegistry.Restore(record)
+	taskRuntime := NewTaskRuntime(taskId, false)
+	taskRuntime.registry = m.taskRegistry
+	taskRuntime.OriginImageURL = record.OriginImageURL
+	taskRuntime.OriginImageId = record.OriginImageId
+	taskRuntime.OriginImageMessageId = record.OriginImageMessageId
+	taskRuntime.TaskKeywordHash = getHashFromRecordPrompt(record.Prompt)
+	for index, upscaledImage := range record.UpscaledImages {
+		taskRuntime.UpscaledImages[index] = upscaledImage
+	}
+	taskRuntime.State = TaskStateCompleted
+	taskRuntime.responded = true
+	return taskRuntime
+}
+
+// 基于已有任务的四宫格生成变体, 返回一个新的子任务, 子任务的结果同样可以 upscale
+func (m *MidJourneyService) Variation(taskId, index string, priority int, keyName string) (childTaskId string, taskResultChan chan TaskResult, err error) {
+	if !isValidImageIndex(index) {
+		err = ErrInvalidImageIndex
+		return
+	}
+	return m.createChildTask(taskId, MidjourneyTaskTypeImageVariation, priority, keyName, func(parentRuntime *TaskRuntime) (interface{}, string, error) {
+		return ImageVariationTaskPayload{
+			OriginImageId:        parentRuntime.OriginImageId,
+			Index:                index,
+			OriginImageMessageId: parentRuntime.OriginImageMessageId,
+		}, parentRuntime.OriginImageMessageId, nil
+	})
+}
+
+// 使用相同的 prompt 重新生成四宫格, 新任务与父任务关联
+// 与点击 🔄 按钮相同, prompt 中的 --seed 不会改变
+func (m *MidJourneyService) Reroll(taskId string, priority int, keyName string) (childTaskId string, taskResultChan chan TaskResult, err error) {
+	return m.createChildTask(taskId, MidjourneyTaskTypeImageReroll, priority, keyName, func(parentRuntime *TaskRuntime) (interface{}, string, error) {
+		return ImageRerollTaskPayload{
+			OriginImageId:        parentRuntime.OriginImageId,
+			OriginImageMessageId: parentRuntime.OriginImageMessageId,
+		}, parentRuntime.OriginImageMessageId, nil
+	})
+}
+
+// 对 upscale 后的图片进行 zoom out、pan 或 make square, 结果为新的四宫格子任务
+// zoom 与 prompt 只用于 custom zoom, prompt 为空时沿用原来的 prompt
+func (m *MidJourneyService) Outpaint(taskId, index string, action OutpaintAction, zoom float64, prompt string, priority int, keyName string) (childTaskId string, taskResultChan chan TaskResult, err error) {
+	if !isValidImageIndex(index) {
+		err = ErrInvalidImageIndex
+		return
+	}
+	switch action {
+	case OutpaintActionZoomOut2x, OutpaintActionZoomOut1_5x, OutpaintActionMakeSquare,
+		OutpaintActionPanLeft, OutpaintActionPanRight, OutpaintActionPanUp, OutpaintActionPanDown:
+	case OutpaintActionCustomZoom:
+		if zoom <= 1 || zoom > 2 {
+			err = ErrInvalidCustomZoom
+			return
+		}
+	default:
+		err = ErrInvalidOutpaintAction
+		return
+	}
+	return m.createChildTask(taskId, MidjourneyTaskTypeImageOutpaint, priority, keyName, func(parentRuntime *TaskRuntime) (interface{}, string, error) {
+		upscaledImage, exist := parentRuntime.UpscaledImages[index]
+		if !exist || upscaledImage.ImageId == "" {
+			return nil, "", ErrUpscaledImageNotFound
+		}
+		return ImageOutpaintTaskPayload{
+			UpscaledImageId:   upscaledImage.ImageId,
+			UpscaledMessageId: upscaledImage.MessageId,
+			Action:            action,
+			Zoom:              zoom,
+			Prompt:            strings.TrimSpace(prompt),
+		}, upscaledImage.MessageId, nil
+	})
+}
+
+// 创建基于父任务消息的子任务, buildPayload 根据父任务生成子任务的 payload 以及被点击按钮所在的消息 id
+func (m *MidJourneyService) createChildTask(taskId string, taskType MidjourneyTaskType, priority int, keyName string, buildPayload func(parentRuntime *TaskRuntime) (interface{}, string, error)) (childTaskId string, taskResultChan chan TaskResult, err error) {
+	bot, err := m.GetBot(taskId)
+	if err != nil {
+		return
+	}
+	// 子任务固定在父任务的 bot 上执行, 不会分配到其他 bot
+	release, err := m.admission.Admit(bot)
+	if err != nil {
+		return
+	}
+	defer release()
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	parentRuntime, exist := bot.taskRuntimes[taskId]
+	if !exist {
+		if parentRuntime = m.restoreTaskRuntime(taskId); parentRuntime == nil {
+			err = ErrTaskNotFound
+			return
+		}
+		bot.taskRuntimes[taskId] = parentRuntime
+	}
+	if parentRuntime.OriginImageMessageId == "" {
+		err = ErrOriginImageNotReady
+		return
+	}
+	parentRecord, _ := m.taskRegistry.Get(taskId)
+	taskPayload, sourceMessageId, err := buildPayload(parentRuntime)
+	if err != nil {
+		return
+	}
+
+	childTaskId = uuid.New().String()
+	// 子任务必须由同一个 bot 执行, 否则无法点击原消息上的按钮
+	m.taskIdToBotId.Store(childTaskId, bot.BotId)
+	taskRuntime := NewTaskRuntime(childTaskId, false)
+	taskRuntime.registry = m.taskRegistry
+	taskRuntime.ParentTaskId = taskId
+	taskRuntime.SourceMessageId = sourceMessageId
+	taskRuntime.TaskKeywordHash = parentRuntime.TaskKeywordHash
+	taskResultChan = taskRuntime.taskResultChan
+	bot.taskRuntimes[childTaskId] = taskRuntime
+	m.taskRegistry.Add(&TaskRecord{
+		TaskId:       childTaskId,
+		TaskType:     taskType,
+		ParentTaskId: taskId,
+		Prompt:       parentRecord.Prompt,
+		BotId:        bot.BotId,
+		BotUniqueId:  bot.UniqueId,
+		APIKeyName:   keyName,
+	})
+	payload, _ := json.Marshal(taskPayload)
+	bot.taskQueue.Push(&MidjourneyTask{
+		TaskId:   childTaskId,
+		TaskType: taskType,
+		Payload:  payload,
+		Priority: priority,
+	})
+	return
+}
+
+// blend 2-5 张图片, dimensions 可以为 portrait(2:3)、square(1:1)、landscape(3:2) 或者为空
+func (m *MidJourneyService) Blend(files []*multipart.FileHeader, dimensions string, priority int, keyName string) (taskId string, taskResultChan chan TaskResult, err error) {
+	if len(files) < 2 || len(files) > 5 {
+		err = ErrInvalidBlendImages
+		return
+	}
+	switch dimensions {
+	case "":
+	case "portrait":
+		dimensions = "--ar 2:3"
+	case "square":
+		dimensions = "--ar 1:1"
+	case "landscape":
+		dimensions = "--ar 3:2"
+	default:
+		err = ErrInvalidBlendDimensions
+		return
+	}
+	taskId = uuid.New().String()
+	bot, err := m.GetBot(taskId)
+	if err != nil {
+		return
+	}
+	release, err := m.admit(taskId, bot)
+	if err != nil {
+		return
+	}
+	defer release()
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	bot.FileHeaders.Store(taskId, files)
+	taskRuntime := NewTaskRuntime(taskId, false)
+	taskRuntime.registry = m.taskRegistry
+	taskResultChan = taskRuntime.taskResultChan
+	bot.taskRuntimes[taskId] = taskRuntime
+	m.taskRegistry.Add(&TaskRecord{
+		TaskId:      taskId,
+		TaskType:    MidjourneyTaskTypeImageBlend,
+		Dimensions:  dimensions,
+		BotId:       bot.BotId,
+		BotUniqueId: bot.UniqueId,
+		APIKeyName:  keyName,
+	})
+	taskPayload := ImageBlendTaskPayload{
+		Dimensions: dimensions,
+	}
+	for _, file := range files {
+		taskPayload.ImageFileNames = append(taskPayload.ImageFileNames, file.Filename)
+		taskPayload.ImageFileSizes = append(taskPayload.ImageFileSizes, int(file.Size))
+	}
+	payload, _ := json.Marshal(taskPayload)
+	bot.taskQueue.Push(&MidjourneyTask{
+		TaskId:   taskId,
+		TaskType: MidjourneyTaskTypeImageBlend,
+		Payload:  payload,
+		Priority: priority,
+	})
+	return
+}
+
+// 分析 prompt 中各个 token 的重要程度, 并给出精简后的 prompt
+func (m *MidJourneyService) Shorten(prompt string, priority int, keyName string) (taskId string, taskResultChan chan TaskResult, err error) {
+	taskId = uuid.New().String()
+	bot, err := m.GetBot(taskId)
+	if err != nil {
+		return
+	}
+	release, err := m.admit(taskId, bot)
+	if err != nil {
+		return
 	}
+	defer release()
+	bot.runtimesLock.Lock()
+	defer bot.runtimesLock.Unlock()
+	taskRuntime := NewTaskRuntime(taskId, false)
+	taskRuntime.registry = m.taskRegistry
+	taskResultChan = taskRuntime.taskResultChan
+	bot.taskRuntimes[taskId] = taskRuntime
+	m.taskRegistry.Add(&TaskRecord{
+		TaskId:      taskId,
+		TaskType:    MidjourneyTaskTypePromptShorten,
+		Prompt:      prompt,
+		BotId:       bot.BotId,
+		BotUniqueId: bot.UniqueId,
+		APIKeyName:  keyName,
+	})
+	payload, _ := json.Marshal(PromptShortenTaskPayload{
+		Prompt: prompt,
+	})
+	bot.taskQueue.Push(&MidjourneyTask{
+		TaskId:   taskId,
+		TaskType: MidjourneyTaskTypePromptShorten,
+		Payload:  payload,
+		Priority: priority,
+	})
 	return
 }
 
-func (m *MidJourneyService) Describe(file *multipart.FileHeader, filename string, size int) (taskId string, taskResultChan chan TaskResult, err error) {
+func (m *MidJourneyService) Describe(file *multipart.FileHeader, filename string, size int, priority int, keyName string) (taskId string, taskResultChan chan TaskResult, err error) {
 	taskId = uuid.New().String()
 	bot, err := m.GetBot(taskId)
 	if err != nil {
 		return
 	}
+	release, err := m.admit(taskId, bot)
+	if err != nil {
+		return
+	}
+	defer release()
 	bot.runtimesLock.Lock()
 	defer bot.runtimesLock.Unlock()
 	bot.FileHeaders.Store(taskId, file)
 	taskRuntime := NewTaskRuntime(taskId, false)
+	taskRuntime.registry = m.taskRegistry
 	taskResultChan = taskRuntime.taskResultChan
 	bot.taskRuntimes[taskId] = taskRuntime
+	m.taskRegistry.Add(&TaskRecord{
+		TaskId:      taskId,
+		TaskType:    MidjourneyTaskTypeImageDescribe,
+		BotId:       bot.BotId,
+		BotUniqueId: bot.UniqueId,
+		APIKeyName:  keyName,
+	})
 	payload, _ := json.Marshal(ImageDescribeTaskPayload{
 		ImageFileName: filename,
 		ImageFileSize: size,
 	})
-	bot.taskChan <- &MidjourneyTask{
+	bot.taskQueue.Push(&MidjourneyTask{
 		TaskId:   taskId,
 		TaskType: MidjourneyTaskTypeImageDescribe,
 		Payload:  payload,
-	}
+		Priority: priority,
+	})
 	return
 }
@@ -0,0 +1,63 @@
+package discordmd
+
+import (
+	"github.com/haojie06/midjourney-http/internal/logger"
+)
+
+// 全局维护模式, 开启后拒绝所有新任务, 可以通过 idle 判断是否可以安全地重新部署
+func (m *MidJourneyService) SetMaintenance(enabled bool) {
+	m.maintenance.Store(enabled)
+	logger.Infof("service maintenance mode: %t", enabled)
+}
+
+// 返回是否处于维护模式以及所有 bot 是否都已经空闲
+func (m *MidJourneyService) MaintenanceStatus() (enabled, idle bool) {
+	idle = true
+	for _, bot := range m.listBots() {
+		if !bot.Idle() {
+			idle = false
+			break
+		}
+	}
+	return m.maintenance.Load(), idle
+}
+
+// 还在使用的 bot 都处于维护模式, 与 bot 不可用区分开, 调用时需持有 botMapMutex
+func allBotsInMaintenance(bots map[string]*DiscordBot) bool {
+	active := 0
+	for _, bot := range bots {
+		if bot.Retired() || !bot.Enabled() {
+			continue
+		}
+		if !bot.InMaintenance() {
+			return false
+		}
+		active++
+	}
+	return active > 0
+}
+
+// bot 维护模式, 不再分配新任务, 执行中的任务以及已有任务的 upscale 等操作照常进行
+func (m *MidJourneyService) SetBotMaintenance(uniqueId string, enabled bool) (status BotStatus, err error) {
+	m.botMapMutex.Lock()
+	bot := m.getBotByUniqueId(uniqueId)
+	m.botMapMutex.Unlock()
+	if bot == nil {
+		err = ErrBotNotFound
+		return
+	}
+	bot.maintenance.Store(enabled)
+	logger.Infof("bot %s maintenance mode: %t", uniqueId, enabled)
+	return bot.Status(), nil
+}
+
+func (m *MidJourneyService) GetBotStatus(uniqueId string) (status BotStatus, err error) {
+	m.botMapMutex.Lock()
+	bot := m.getBotByUniqueId(uniqueId)
+	m.botMapMutex.Unlock()
+	if bot == nil {
+		err = ErrBotNotFound
+		return
+	}
+	return bot.Status(), nil
+}
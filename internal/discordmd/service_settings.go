@@ -0,0 +1,89 @@
+package discordmd
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/haojie06/midjourney-http/internal/logger"
+)
+
+// 获取 bot 的 /settings, 没有缓存或者 refresh 为 true 时重新执行
+func (m *MidJourneyService) GetSettings(uniqueId string, refresh bool) (settings BotSettings, err error) {
+	m.botMapMutex.Lock()
+	bot := m.getBotByUniqueId(uniqueId)
+	m.botMapMutex.Unlock()
+	if bot == nil {
+		err = ErrBotNotFound
+		return
+	}
+	settings, exist := bot.GetSettings()
+	if exist && !refresh {
+		return
+	}
+	return m.executeSettings(bot, nil)
+}
+
+// 修改 bot 的 /settings, profile 中为空的字段保持不变
+func (m *MidJourneyService) UpdateSettings(uniqueId string, profile BotSettingsProfile) (settings BotSettings, err error) {
+	if !validateSettingsProfile(profile) {
+		err = ErrInvalidSettingsProfile
+		return
+	}
+	m.botMapMutex.Lock()
+	bot := m.getBotByUniqueId(uniqueId)
+	m.botMapMutex.Unlock()
+	if bot == nil {
+		err = ErrBotNotFound
+		return
+	}
+	return m.executeSettings(bot, &profile)
+}
+
+func (m *MidJourneyService) executeSettings(bot *DiscordBot, profile *BotSettingsProfile) (settings BotSettings, err error) {
+	payload, err := json.Marshal(BotSettingsTaskPayload{Profile: profile})
+	if err != nil {
+		return
+	}
+	taskId := uuid.New().String()
+	bot.runtimesLock.Lock()
+	taskRuntime := NewTaskRuntime(taskId, false)
+	taskResultChan := taskRuntime.taskResultChan
+	bot.taskRuntimes[taskId] = taskRuntime
+	bot.taskQueue.Push(&MidjourneyTask{
+		TaskId:   taskId,
+		TaskType: MidjourneyTaskTypeBotSettings,
+		Payload:  payload,
+	})
+	bot.runtimesLock.Unlock()
+
+	select {
+	case result := <-taskResultChan:
+		settings, _ = result.Payload.(BotSettings)
+		if !result.Successful {
+			if result.Message != "" {
+				err = errors.New(result.Message)
+			} else {
+				err = ErrFailedToGetSettings
+			}
+		}
+		return
+	case <-time.After(3 * time.Minute):
+		bot.runtimesLock.Lock()
+		bot.RemoveTaskRuntime(taskId)
+		bot.runtimesLock.Unlock()
+		err = ErrFailedToGetSettings
+		return
+	}
+}
+
+// 启动时应用配置文件中的设置, 保证每个账号的模型版本等参数一致
+func (m *MidJourneyService) applySettingsProfile(bot *DiscordBot, profile BotSettingsProfile) {
+	settings, err := m.UpdateSettings(bot.UniqueId, profile)
+	if err != nil {
+		logger.Errorf("failed to apply settings to bot %s, err: %s", bot.UniqueId, err)
+		return
+	}
+	logger.Infof("settings applied to bot %s, version: %s, stylize: %s", bot.UniqueId, settings.Version, settings.Stylize)
+}
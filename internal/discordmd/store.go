@@ -0,0 +1,105 @@
+package discordmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	tasksBucket = []byte("tasks")
+)
+
+// TaskStore 持久化任务记录, 服务重启后用于恢复任务与 bot 的对应关系以及 upscale 所需的消息 id
+type TaskStore interface {
+	SaveTask(record TaskRecord) error
+
+	GetTask(taskId string) (record TaskRecord, exist bool, err error)
+
+	ListTasks() ([]TaskRecord, error)
+
+	DeleteTasks(taskIds []string) error
+
+	Close() error
+}
+
+// 基于 bbolt 的本地存储, 以 taskId 为 key 保存 json 序列化后的 TaskRecord
+type BoltTaskStore struct {
+	db *bolt.DB
+}
+
+func NewBoltTaskStore(path string) (*BoltTaskStore, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tasksBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltTaskStore{db: db}, nil
+}
+
+func (s *BoltTaskStore) SaveTask(record TaskRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tasksBucket).Put([]byte(record.TaskId), value)
+	})
+}
+
+func (s *BoltTaskStore) GetTask(taskId string) (record TaskRecord, exist bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(tasksBucket).Get([]byte(taskId))
+		if value == nil {
+			return nil
+		}
+		exist = true
+		return json.Unmarshal(value, &record)
+	})
+	return
+}
+
+func (s *BoltTaskStore) ListTasks() (records []TaskRecord, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tasksBucket).ForEach(func(k, v []byte) error {
+			var record TaskRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return
+}
+
+func (s *BoltTaskStore) DeleteTasks(taskIds []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tasksBucket)
+		for _, taskId := range taskIds {
+			if err := bucket.Delete([]byte(taskId)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltTaskStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,110 @@
+package discordmd
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// 优先级的范围, 超出时取边界值
+const (
+	minTaskPriority = -10
+	maxTaskPriority = 10
+)
+
+// 每个 bot 的任务队列, upscale 总是先于新任务, 其余按优先级从高到低, 同优先级按提交顺序
+// upscale 只是点击已有任务的按钮, 不让高优先级的新任务把它们饿死
+// Push 不会阻塞调用方, 可以在持有 runtimesLock 时调用
+type TaskQueue struct {
+	tasks []*MidjourneyTask
+
+	seq uint64
+
+	lock sync.Mutex
+
+	notify chan struct{}
+}
+
+func NewTaskQueue() *TaskQueue {
+	return &TaskQueue{
+		tasks:  make([]*MidjourneyTask, 0),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+func (q *TaskQueue) Push(task *MidjourneyTask) {
+	q.lock.Lock()
+	q.seq++
+	task.seq = q.seq
+	task.Priority = clampPriority(task.Priority)
+	task.EnqueuedAt = time.Now()
+	// 保持有序, 插入到第一个排在其后的任务之前
+	index := sort.Search(len(q.tasks), func(i int) bool {
+		return task.before(q.tasks[i])
+	})
+	q.tasks = append(q.tasks, nil)
+	copy(q.tasks[index+1:], q.tasks[index:])
+	q.tasks[index] = task
+	q.lock.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 取出第一个满足 ready 的任务, 没有时返回 nil; 例如执行名额已满时, upscale 仍然可以越过排队中的新任务
+func (q *TaskQueue) PopFirst(ready func(task *MidjourneyTask) bool) *MidjourneyTask {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, task := range q.tasks {
+		if ready(task) {
+			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+			return task
+		}
+	}
+	return nil
+}
+
+// 有新任务入队时收到通知
+func (q *TaskQueue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+// 任务在队列中的位置, 从 1 开始, 不在队列中时返回 0
+func (q *TaskQueue) Position(taskId string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, task := range q.tasks {
+		if task.TaskId == taskId {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (q *TaskQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.tasks)
+}
+
+func (t *MidjourneyTask) before(other *MidjourneyTask) bool {
+	tUpscale, otherUpscale := t.TaskType == MidjourneyTaskTypeImageUpscale, other.TaskType == MidjourneyTaskTypeImageUpscale
+	if tUpscale != otherUpscale {
+		return tUpscale
+	}
+	if t.Priority != other.Priority {
+		return t.Priority > other.Priority
+	}
+	return t.seq < other.seq
+}
+
+func clampPriority(priority int) int {
+	if priority < minTaskPriority {
+		return minTaskPriority
+	}
+	if priority > maxTaskPriority {
+		return maxTaskPriority
+	}
+	return priority
+}
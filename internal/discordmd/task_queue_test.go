@@ -0,0 +1,117 @@
+package discordmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func popAll(queue *TaskQueue) (taskIds []string) {
+	for {
+		task := queue.PopFirst(func(task *MidjourneyTask) bool { return true })
+		if task == nil {
+			return
+		}
+		taskIds = append(taskIds, task.TaskId)
+	}
+}
+
+func TestTaskQueueOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		tasks []*MidjourneyTask
+		want  []string
+	}{
+		{
+			name: "submission order",
+			tasks: []*MidjourneyTask{
+				{TaskId: "a", TaskType: MidjourneyTaskTypeImageGeneration},
+				{TaskId: "b", TaskType: MidjourneyTaskTypeImageGeneration},
+				{TaskId: "c", TaskType: MidjourneyTaskTypeImageDescribe},
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "higher priority first",
+			tasks: []*MidjourneyTask{
+				{TaskId: "a", TaskType: MidjourneyTaskTypeImageGeneration},
+				{TaskId: "b", TaskType: MidjourneyTaskTypeImageGeneration, Priority: 2},
+				{TaskId: "c", TaskType: MidjourneyTaskTypeImageGeneration, Priority: 1},
+				{TaskId: "d", TaskType: MidjourneyTaskTypeImageGeneration, Priority: 2},
+			},
+			want: []string{"b", "d", "c", "a"},
+		},
+		{
+			name: "upscales ahead of any priority",
+			tasks: []*MidjourneyTask{
+				{TaskId: "a", TaskType: MidjourneyTaskTypeImageGeneration, Priority: 10},
+				{TaskId: "b", TaskType: MidjourneyTaskTypeImageUpscale},
+				{TaskId: "c", TaskType: MidjourneyTaskTypeImageUpscale, Priority: 1},
+			},
+			want: []string{"c", "b", "a"},
+		},
+		{
+			name: "priority is clamped",
+			tasks: []*MidjourneyTask{
+				{TaskId: "a", TaskType: MidjourneyTaskTypeImageGeneration, Priority: maxTaskPriority},
+				{TaskId: "b", TaskType: MidjourneyTaskTypeImageGeneration, Priority: 1000},
+				{TaskId: "c", TaskType: MidjourneyTaskTypeImageGeneration, Priority: -1000},
+				{TaskId: "d", TaskType: MidjourneyTaskTypeImageGeneration, Priority: minTaskPriority},
+			},
+			want: []string{"a", "b", "c", "d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := NewTaskQueue()
+			for _, task := range tt.tasks {
+				queue.Push(task)
+			}
+			if got := popAll(queue); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pop order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaskQueuePosition(t *testing.T) {
+	queue := NewTaskQueue()
+	queue.Push(&MidjourneyTask{TaskId: "a", TaskType: MidjourneyTaskTypeImageGeneration})
+	queue.Push(&MidjourneyTask{TaskId: "b", TaskType: MidjourneyTaskTypeImageGeneration, Priority: 1})
+	queue.Push(&MidjourneyTask{TaskId: "c", TaskType: MidjourneyTaskTypeImageUpscale})
+	tests := []struct {
+		taskId string
+		want   int
+	}{
+		{"c", 1},
+		{"b", 2},
+		{"a", 3},
+		{"missing", 0},
+	}
+	for _, tt := range tests {
+		if got := queue.Position(tt.taskId); got != tt.want {
+			t.Errorf("Position(%s) = %d, want %d", tt.taskId, got, tt.want)
+		}
+	}
+	if queue.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", queue.Len())
+	}
+}
+
+func TestTaskQueuePopFirstSkipsNotReady(t *testing.T) {
+	queue := NewTaskQueue()
+	queue.Push(&MidjourneyTask{TaskId: "a", TaskType: MidjourneyTaskTypeImageGeneration, Priority: 1})
+	queue.Push(&MidjourneyTask{TaskId: "b", TaskType: MidjourneyTaskTypeImageDescribe})
+	// 例如执行名额已满时只允许取出 describe
+	task := queue.PopFirst(func(task *MidjourneyTask) bool {
+		return task.TaskType == MidjourneyTaskTypeImageDescribe
+	})
+	if task == nil || task.TaskId != "b" {
+		t.Fatalf("PopFirst() = %+v, want b", task)
+	}
+	if queue.Position("a") != 1 {
+		t.Errorf("Position(a) = %d, want 1", queue.Position("a"))
+	}
+	if task = queue.PopFirst(func(task *MidjourneyTask) bool { return false }); task != nil {
+		t.Errorf("PopFirst() = %+v, want nil", task)
+	}
+}
@@ -5,11 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 )
 
 func (bot *DiscordBot) uploadImageToAttachment(fileName string, attachmentId string, fileSize int, file io.Reader) (uploadFileName string, err error) {
-	attachmentAPI := fmt.Sprintf("https://discord.com/api/v9/channels/%s/attachments", bot.config.DiscordChannelId)
+	attachmentAPI := fmt.Sprintf("https://discord.com/api/v9/channels/%s/attachments", bot.Config().DiscordChannelId)
 	attachmentRequest := AttachmentRequest{
 		Files: []AttachmentFile{
 			{
@@ -22,7 +23,7 @@ func (bot *DiscordBot) uploadImageToAttachment(fileName string, attachmentId str
 	requestBody, _ := json.Marshal(attachmentRequest)
 	request, _ := http.NewRequest("POST", attachmentAPI, bytes.NewBuffer(requestBody))
 	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Authorization", bot.config.DiscordToken)
+	request.Header.Set("Authorization", bot.Config().DiscordToken)
 	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return
@@ -52,3 +53,29 @@ func (bot *DiscordBot) uploadImageToAttachment(fileName string, attachmentId str
 	defer resp.Body.Close()
 	return
 }
+
+// 任务记录中保存的是追加了 seed 的完整 prompt, 重新计算 keyword hash
+func getHashFromRecordPrompt(prompt string) string {
+	seed, ok := getLastSeedFromMessage(prompt)
+	if !ok {
+		return ""
+	}
+	return getHashFromPrompt(prompt, seed)
+}
+
+func isValidImageIndex(index string) bool {
+	switch index {
+	case "1", "2", "3", "4":
+		return true
+	}
+	return false
+}
+
+func (bot *DiscordBot) uploadFileHeaderToAttachment(fileHeader *multipart.FileHeader, fileName string, attachmentId string, fileSize int) (uploadFileName string, err error) {
+	fileReader, err := fileHeader.Open()
+	if err != nil {
+		return
+	}
+	defer fileReader.Close()
+	return bot.uploadImageToAttachment(fileName, attachmentId, fileSize, fileReader)
+}
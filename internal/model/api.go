@@ -12,10 +12,16 @@ type GenerationTaskRequest struct {
 
 	ReportType string `json:"report_type"`
 
-	FastMode bool `json:"fast_mode"`
+	Mode string `json:"mode"` // fast、relax 或 turbo, 为空时使用 bot 的默认模式, 没有默认模式时为 relax
+
+	FastMode bool `json:"fast_mode"` // 兼容旧参数, mode 为空时等同于 fast
 
 	AutoUpscale bool `json:"auto_upscale"`
 
+	SplitGrid bool `json:"split_grid"` // 在服务端切分四宫格, 不会再自动 upscale, 需要配置 storage
+
+	Priority int `json:"priority"` // 越大越先执行, 默认为 0, 范围为 -10 到 10
+
 	WebhookConfig WebhookConfig `json:"webhook_config"`
 }
 
@@ -23,6 +29,64 @@ type UpscaleTaskRequest struct {
 	TaskId string `json:"task_id"`
 
 	Index string `json:"index"`
+
+	Priority int `json:"priority"`
+}
+
+type VariationTaskRequest struct {
+	TaskId string `json:"task_id"`
+
+	Index string `json:"index"`
+
+	Priority int `json:"priority"`
+}
+
+type RerollTaskRequest struct {
+	TaskId string `json:"task_id"`
+
+	Priority int `json:"priority"`
+}
+
+type OutpaintTaskRequest struct {
+	TaskId string `json:"task_id"`
+
+	Index string `json:"index"` // 对第几张 upscale 后的图片进行操作
+
+	Action string `json:"action"` // zoom_out_2x, zoom_out_1_5x, make_square, pan_left, pan_right, pan_up, pan_down, custom_zoom
+
+	Zoom float64 `json:"zoom"` // custom_zoom 的倍数, 大于 1 且不超过 2
+
+	Prompt string `json:"prompt"` // custom_zoom 时可以修改 prompt, 为空时使用原来的 prompt
+
+	Priority int `json:"priority"`
+}
+
+type SplitTaskRequest struct {
+	TaskId string `json:"task_id"`
+}
+
+type ShortenTaskRequest struct {
+	Prompt string `json:"prompt"`
+
+	Priority int `json:"priority"`
+}
+
+type MaintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name string `json:"name"`
+
+	Key string `json:"key"` // 为空时随机生成
+
+	Scopes []string `json:"scopes"` // imagine、upscale、describe、admin
+
+	ExpiresAt string `json:"expires_at"` // RFC3339 或 2006-01-02
+
+	RequestsPerMinute int `json:"requests_per_minute"`
+
+	DailyQuotas map[string]int `json:"daily_quotas"`
 }
 
 // 响应部分
@@ -34,20 +98,110 @@ type TaskHTTPResponse struct {
 	Message string `json:"message"`
 
 	Payload interface{} `json:"payload"`
+
+	QueueDepth int `json:"queue_depth,omitempty"` // 排队中的任务数量, 创建任务以及被限流时返回
+
+	QueuePosition int `json:"queue_position,omitempty"` // 任务在所属 bot 队列中的位置, 从 1 开始
 }
 
 type GenerationTaskResponsePayload struct {
 	ImageURLs []string `json:"image_urls"`
 
 	OriginImageURL string `json:"origin_image_url"`
+
+	MirroredImageURLs []string `json:"mirrored_image_urls,omitempty"` // 开启图片转存后返回
+
+	MirroredOriginImageURL string `json:"mirrored_origin_image_url,omitempty"`
+
+	SplitImageURLs []string `json:"split_image_urls,omitempty"`
+}
+
+type SplitTaskResponsePayload struct {
+	ImageURLs []string `json:"image_urls"`
+}
+
+// variation、reroll、outpaint 等子任务的响应
+type ChildTaskResponsePayload struct {
+	ParentTaskId string `json:"parent_task_id"`
+
+	OriginImageURL string `json:"origin_image_url"`
+
+	MirroredOriginImageURL string `json:"mirrored_origin_image_url,omitempty"`
 }
 
 type UpscaleTaskResponsePayload struct {
 	ImageURL string `json:"image_url"`
 
 	Index string `json:"index"`
+
+	MirroredImageURL string `json:"mirrored_image_url,omitempty"`
 }
 
 type DescribeTaskResponsePayload struct {
 	Description string `json:"description"`
 }
+
+type ShortenToken struct {
+	Token string `json:"token"`
+
+	Weight float64 `json:"weight"`
+
+	Important bool `json:"important"`
+
+	Removed bool `json:"removed"`
+}
+
+type ShortenTaskResponsePayload struct {
+	Tokens []ShortenToken `json:"tokens"`
+
+	ShortenedPrompts []string `json:"shortened_prompts"`
+}
+
+// WebSocket 部分, 同一连接上的多个任务通过 request_id 与 task_id 区分
+type WSRequest struct {
+	Type string `json:"type"` // auth, imagine, upscale, describe
+
+	RequestId string `json:"request_id"` // 客户端生成, 原样返回以便对应 ack
+
+	APIKey string `json:"api_key"`
+
+	Prompt string `json:"prompt"`
+
+	Params string `json:"params"`
+
+	Mode string `json:"mode"` // fast、relax 或 turbo, 为空时使用 bot 的默认模式, 没有默认模式时为 relax
+
+	FastMode bool `json:"fast_mode"` // 兼容旧参数, mode 为空时等同于 fast
+
+	AutoUpscale bool `json:"auto_upscale"`
+
+	SplitGrid bool `json:"split_grid"`
+
+	Priority int `json:"priority"`
+
+	TaskId string `json:"task_id"`
+
+	Index string `json:"index"`
+
+	Image string `json:"image"` // describe 使用, base64 编码的图片
+
+	Filename string `json:"filename"`
+}
+
+type WSMessage struct {
+	Type string `json:"type"` // authenticated, ack, state, progress, result, error
+
+	RequestId string `json:"request_id,omitempty"`
+
+	TaskId string `json:"task_id,omitempty"`
+
+	Status string `json:"status,omitempty"`
+
+	Message string `json:"message,omitempty"`
+
+	Payload interface{} `json:"payload,omitempty"`
+
+	QueueDepth int `json:"queue_depth,omitempty"`
+
+	QueuePosition int `json:"queue_position,omitempty"`
+}
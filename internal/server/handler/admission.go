@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/discordmd"
+	"github.com/haojie06/midjourney-http/internal/model"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+// 创建任务失败时的响应, 超过并发上限时返回 429 以及 Retry-After, 没有可用的 bot 或者处于维护模式时返回 503
+func respondTaskCreationError(c *gin.Context, taskId string, err error) {
+	if errors.Is(err, discordmd.ErrNoHealthyBot) || errors.Is(err, discordmd.ErrBotDisabled) || errors.Is(err, discordmd.ErrServiceInMaintenance) || errors.Is(err, discordmd.ErrAllBotsInMaintenance) {
+		utils.GinFailedWithMessageAndTaskId(c, 503, taskId, err.Error())
+		return
+	}
+	if !errors.Is(err, discordmd.ErrTooManyTasks) {
+		utils.GinFailedWithMessageAndTaskId(c, 400, taskId, err.Error())
+		return
+	}
+	response := model.TaskHTTPResponse{
+		TaskId:  taskId,
+		Status:  "failed",
+		Message: discordmd.ErrTooManyTasks.Error(),
+	}
+	var admissionErr *discordmd.AdmissionError
+	if errors.As(err, &admissionErr) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(admissionErr.RetryAfter.Seconds()))))
+		response.QueueDepth = admissionErr.QueueDepth
+	}
+	c.JSON(429, response)
+}
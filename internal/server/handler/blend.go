@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/auth"
+	"github.com/haojie06/midjourney-http/internal/discordmd"
+	"github.com/haojie06/midjourney-http/internal/logger"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+func CreateBlendTask(c *gin.Context) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	files := form.File["images"]
+	dimensions := c.PostForm("dimensions")
+	priority, _ := strconv.Atoi(c.PostForm("priority"))
+
+	if !reserveQuota(c, auth.QuotaImagine) {
+		return
+	}
+	taskId, taskResultChan, err := discordmd.MidJourneyServiceApp.Blend(files, dimensions, priority, requestKeyName(c))
+	if err != nil {
+		refundQuota(c, auth.QuotaImagine)
+		respondTaskCreationError(c, taskId, err)
+		return
+	}
+	logger.Infof("blend task %s is created, images: %d", taskId, len(files))
+	select {
+	case <-time.After(60 * time.Minute):
+		discardTaskResult(taskResultChan)
+		logger.Infof("task %s timeout", taskId)
+		utils.GinFailedWithMessageAndTaskId(c, 408, taskId, "timeout")
+		return
+	case result := <-taskResultChan:
+		status, response := buildGenerationResponse(result)
+		c.JSON(status, response)
+	}
+}
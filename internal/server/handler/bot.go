@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/discordmd"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+// 所有 bot 的状态、健康状况以及执行中的任务
+func ListBots(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"bots": discordmd.MidJourneyServiceApp.ListBotStatus(),
+	})
+}
+
+// 添加 bot, 请求体为 DiscordBotConfig
+func AddBot(c *gin.Context) {
+	var config discordmd.DiscordBotConfig
+	if err := c.ShouldBindJSON(&config); err != nil {
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	status, err := discordmd.MidJourneyServiceApp.AddBot(config)
+	if err != nil {
+		switch {
+		case errors.Is(err, discordmd.ErrBotExists):
+			utils.GinFailedWithMessage(c, 409, err.Error())
+		case errors.Is(err, discordmd.ErrInvalidBotConfig), errors.Is(err, discordmd.ErrInvalidJobMode):
+			utils.GinFailedWithMessage(c, 400, err.Error())
+		default:
+			utils.GinFailedWithMessage(c, 502, err.Error())
+		}
+		return
+	}
+	c.JSON(200, gin.H{
+		"bot": status,
+	})
+}
+
+// 移除 bot, 执行中的任务结束后才会断开连接
+func RemoveBot(c *gin.Context) {
+	if err := discordmd.MidJourneyServiceApp.RemoveBot(c.Param("uniqueId")); err != nil {
+		utils.GinFailedWithMessage(c, 404, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{
+		"message": "removing",
+	})
+}
+
+func EnableBot(c *gin.Context) {
+	setBotEnabled(c, true)
+}
+
+func DisableBot(c *gin.Context) {
+	setBotEnabled(c, false)
+}
+
+func setBotEnabled(c *gin.Context, enabled bool) {
+	status, err := discordmd.MidJourneyServiceApp.SetBotEnabled(c.Param("uniqueId"), enabled)
+	if err != nil {
+		utils.GinFailedWithMessage(c, 404, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{
+		"bot": status,
+	})
+}
+
+// 获取 bot 对应账号的订阅、剩余 fast 时间等信息, refresh=true 时强制重新执行 /info
+func GetBotAccountInfo(c *gin.Context) {
+	uniqueId := c.Param("uniqueId")
+	refresh := c.Query("refresh") == "true"
+	info, err := discordmd.MidJourneyServiceApp.GetAccountInfo(uniqueId, refresh)
+	if err != nil {
+		if err == discordmd.ErrBotNotFound {
+			utils.GinFailedWithMessage(c, 404, err.Error())
+		} else {
+			utils.GinFailedWithMessage(c, 500, err.Error())
+		}
+		return
+	}
+	c.JSON(200, gin.H{
+		"unique_id": uniqueId,
+		"info":      info,
+	})
+}
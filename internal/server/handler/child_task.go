@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/auth"
+	"github.com/haojie06/midjourney-http/internal/discordmd"
+	"github.com/haojie06/midjourney-http/internal/logger"
+	"github.com/haojie06/midjourney-http/internal/model"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+func CreateVariationTask(c *gin.Context) {
+	var req model.VariationTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	if !reserveQuota(c, auth.QuotaImagine) {
+		return
+	}
+	taskId, taskResultChan, err := discordmd.MidJourneyServiceApp.Variation(req.TaskId, req.Index, req.Priority, requestKeyName(c))
+	if err != nil {
+		refundQuota(c, auth.QuotaImagine)
+		respondTaskCreationError(c, req.TaskId, err)
+		return
+	}
+	logger.Infof("variation task %s is created, parent task: %s", taskId, req.TaskId)
+	waitForChildTaskResult(c, req.TaskId, taskId, taskResultChan)
+}
+
+func CreateRerollTask(c *gin.Context) {
+	var req model.RerollTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	if !reserveQuota(c, auth.QuotaImagine) {
+		return
+	}
+	taskId, taskResultChan, err := discordmd.MidJourneyServiceApp.Reroll(req.TaskId, req.Priority, requestKeyName(c))
+	if err != nil {
+		refundQuota(c, auth.QuotaImagine)
+		respondTaskCreationError(c, req.TaskId, err)
+		return
+	}
+	logger.Infof("reroll task %s is created, parent task: %s", taskId, req.TaskId)
+	waitForChildTaskResult(c, req.TaskId, taskId, taskResultChan)
+}
+
+func CreateOutpaintTask(c *gin.Context) {
+	var req model.OutpaintTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	if !reserveQuota(c, auth.QuotaImagine) {
+		return
+	}
+	taskId, taskResultChan, err := discordmd.MidJourneyServiceApp.Outpaint(req.TaskId, req.Index, discordmd.OutpaintAction(req.Action), req.Zoom, req.Prompt, req.Priority, requestKeyName(c))
+	if err != nil {
+		refundQuota(c, auth.QuotaImagine)
+		respondTaskCreationError(c, req.TaskId, err)
+		return
+	}
+	logger.Infof("outpaint task %s is created, parent task: %s, action: %s", taskId, req.TaskId, req.Action)
+	waitForChildTaskResult(c, req.TaskId, taskId, taskResultChan)
+}
+
+// 子任务的结果为新的四宫格, 可以继续 upscale
+func waitForChildTaskResult(c *gin.Context, parentTaskId, taskId string, taskResultChan chan discordmd.TaskResult) {
+	select {
+	case <-time.After(60 * time.Minute):
+		discardTaskResult(taskResultChan)
+		logger.Warnf("task %s timeout", taskId)
+		utils.GinFailedWithMessageAndTaskId(c, 408, taskId, "timeout")
+		return
+	case taskResult := <-taskResultChan:
+		if !taskResult.Successful {
+			utils.GinFailedWithMessageAndTaskId(c, 400, taskId, taskResult.Message)
+			return
+		}
+		payload, ok := taskResult.Payload.(discordmd.ImageGenerationResultPayload)
+		if !ok {
+			utils.GinFailedWithMessageAndTaskId(c, 400, taskId, "payload type error")
+			return
+		}
+		logger.Infof("task %s completed, parent task: %s", taskId, parentTaskId)
+		c.JSON(200, model.TaskHTTPResponse{
+			TaskId: taskId,
+			Status: "completed",
+			Payload: model.ChildTaskResponsePayload{
+				ParentTaskId:           parentTaskId,
+				OriginImageURL:         payload.OriginImageURL,
+				MirroredOriginImageURL: payload.MirroredOriginImageURL,
+			},
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package handler
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/auth"
 	"github.com/haojie06/midjourney-http/internal/discordmd"
 	"github.com/haojie06/midjourney-http/internal/model"
 	"github.com/haojie06/midjourney-http/internal/utils"
@@ -16,32 +18,48 @@ func CreateDescribeTask(c *gin.Context) {
 		return
 	}
 
-	taskId, resultChan, err := discordmd.MidJourneyServiceApp.Describe(file, file.Filename, int(file.Size))
+	priority, _ := strconv.Atoi(c.PostForm("priority"))
+	if !reserveQuota(c, auth.QuotaDescribe) {
+		return
+	}
+	taskId, resultChan, err := discordmd.MidJourneyServiceApp.Describe(file, file.Filename, int(file.Size), priority, requestKeyName(c))
 	if err != nil {
-		utils.GinFailedWithMessageAndTaskId(c, 400, taskId, err.Error())
+		refundQuota(c, auth.QuotaDescribe)
+		respondTaskCreationError(c, taskId, err)
 		return
 	}
 	select {
 	case result := <-resultChan:
-		if !result.Successful {
-			utils.GinFailedWithMessageAndTaskId(c, 400, taskId, result.Message)
-			return
-		}
-		payload, ok := result.Payload.(discordmd.ImageDescribeResultPayload)
-		if !ok {
-			utils.GinFailedWithMessageAndTaskId(c, 400, taskId, "failed to get payload")
-			return
-		}
-		c.JSON(200, model.TaskHTTPResponse{
-			TaskId: taskId,
-			Status: "completed",
-			Payload: model.DescribeTaskResponsePayload{
-				Description: payload.Description,
-			},
-		})
+		status, response := buildDescribeResponse(result)
+		c.JSON(status, response)
 		return
 	case <-time.After(5 * time.Minute):
 		utils.GinFailedWithMessageAndTaskId(c, 408, taskId, "timeout")
 		return
 	}
 }
+
+func buildDescribeResponse(result discordmd.TaskResult) (status int, response model.TaskHTTPResponse) {
+	if !result.Successful {
+		return 400, model.TaskHTTPResponse{
+			TaskId:  result.TaskId,
+			Status:  "failed",
+			Message: result.Message,
+		}
+	}
+	payload, ok := result.Payload.(discordmd.ImageDescribeResultPayload)
+	if !ok {
+		return 400, model.TaskHTTPResponse{
+			TaskId:  result.TaskId,
+			Status:  "failed",
+			Message: "failed to get payload",
+		}
+	}
+	return 200, model.TaskHTTPResponse{
+		TaskId: result.TaskId,
+		Status: "completed",
+		Payload: model.DescribeTaskResponsePayload{
+			Description: payload.Description,
+		},
+	}
+}
@@ -1,13 +1,16 @@
 package handler
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/auth"
 	"github.com/haojie06/midjourney-http/internal/discordmd"
 	"github.com/haojie06/midjourney-http/internal/logger"
 	"github.com/haojie06/midjourney-http/internal/model"
 	"github.com/haojie06/midjourney-http/internal/utils"
+	"github.com/haojie06/midjourney-http/internal/webhook"
 )
 
 func CreateGenerationTask(c *gin.Context) {
@@ -16,69 +19,128 @@ func CreateGenerationTask(c *gin.Context) {
 		utils.GinFailedWithMessage(c, 400, err.Error())
 		return
 	}
-	taskId, taskResultChan, err := discordmd.MidJourneyServiceApp.Imagine(req.Prompt, req.Params, req.FastMode, req.AutoUpscale)
+	if req.ReportType == "webhook" && req.WebhookConfig.URL == "" {
+		utils.GinFailedWithMessage(c, 400, "webhook url is required when report_type is webhook")
+		return
+	}
+	mode, err := requestJobMode(req.Mode, req.FastMode)
 	if err != nil {
-		if err == discordmd.ErrTooManyTasks {
-			utils.GinFailedWithMessageAndTaskId(c, 429, taskId, err.Error())
-		} else {
-			utils.GinFailedWithMessageAndTaskId(c, 400, taskId, err.Error())
-		}
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	if !reserveQuota(c, auth.QuotaImagine) {
+		return
+	}
+	taskId, taskResultChan, err := discordmd.MidJourneyServiceApp.Imagine(req.Prompt, req.Params, mode, req.AutoUpscale, req.SplitGrid, req.Priority, requestKeyName(c))
+	if err != nil {
+		refundQuota(c, auth.QuotaImagine)
+		respondTaskCreationError(c, taskId, err)
 		return
 	}
 	logger.Infof("task %s is created", taskId)
 	// waiting for task to complete, block or webhook
 	if req.ReportType == "webhook" {
+		go reportGenerationResultByWebhook(taskId, req.WebhookConfig.URL, taskResultChan)
 		c.JSON(200, model.TaskHTTPResponse{
-			TaskId: taskId,
-			Status: "pending",
+			TaskId:        taskId,
+			Status:        "pending",
+			QueueDepth:    discordmd.MidJourneyServiceApp.QueueDepth(),
+			QueuePosition: discordmd.MidJourneyServiceApp.QueuePosition(taskId),
 		})
 		return
 	}
 	select {
 	case <-time.After(60 * time.Minute):
+		discardTaskResult(taskResultChan)
 		logger.Infof("task %s timeout", taskId)
 		utils.GinFailedWithMessageAndTaskId(c, 408, taskId, "timeout")
 		return
 	case result := <-taskResultChan:
-		// TODO implement webhook
-		if !result.Successful {
-			utils.GinFailedWithMessageAndTaskId(c, 400, taskId, result.Message)
-			return
+		status, response := buildGenerationResponse(result)
+		c.JSON(status, response)
+	}
+}
+
+// mode 优先, 没有指定时 fast_mode 为 true 等同于 fast
+func requestJobMode(mode string, fastMode bool) (discordmd.JobMode, error) {
+	if mode == "" && fastMode {
+		return discordmd.JobModeFast, nil
+	}
+	return discordmd.ParseJobMode(mode)
+}
+
+// 将任务结果转换为 http 响应, 同步请求与 webhook 共用
+func buildGenerationResponse(result discordmd.TaskResult) (status int, response model.TaskHTTPResponse) {
+	if !result.Successful {
+		return 400, model.TaskHTTPResponse{
+			TaskId:  result.TaskId,
+			Status:  "failed",
+			Message: result.Message,
 		}
-		payload, ok := result.Payload.(discordmd.ImageGenerationResultPayload)
-		if !ok {
-			utils.GinFailedWithMessageAndTaskId(c, 400, taskId, "payload type error")
-			return
+	}
+	payload, ok := result.Payload.(discordmd.ImageGenerationResultPayload)
+	if !ok {
+		return 400, model.TaskHTTPResponse{
+			TaskId:  result.TaskId,
+			Status:  "failed",
+			Message: "payload type error",
 		}
-		logger.Infof("task %s completed", result.TaskId)
-		c.JSON(200, model.TaskHTTPResponse{
-			TaskId: result.TaskId,
-			Status: "completed",
-			Payload: model.GenerationTaskResponsePayload{
-				OriginImageURL: payload.OriginImageURL,
-				ImageURLs:      payload.ImageURLs,
-			},
-		})
 	}
+	logger.Infof("task %s completed", result.TaskId)
+	return 200, model.TaskHTTPResponse{
+		TaskId: result.TaskId,
+		Status: "completed",
+		Payload: model.GenerationTaskResponsePayload{
+			OriginImageURL:         payload.OriginImageURL,
+			ImageURLs:              payload.ImageURLs,
+			MirroredOriginImageURL: payload.MirroredOriginImageURL,
+			MirroredImageURLs:      payload.MirroredImageURLs,
+			SplitImageURLs:         payload.SplitImageURLs,
+		},
+	}
+}
+
+func reportGenerationResultByWebhook(taskId, url string, taskResultChan chan discordmd.TaskResult) {
+	var response model.TaskHTTPResponse
+	select {
+	case <-time.After(60 * time.Minute):
+		discardTaskResult(taskResultChan)
+		logger.Infof("task %s timeout", taskId)
+		response = model.TaskHTTPResponse{
+			TaskId:  taskId,
+			Status:  "failed",
+			Message: "timeout",
+		}
+	case result := <-taskResultChan:
+		_, response = buildGenerationResponse(result)
+	}
+	webhook.DispatcherApp.Dispatch(url, taskId, response)
 }
 
 func GenerationImageFromGetRequest(c *gin.Context) {
 	prompt := c.Query("prompt")
 	params := c.Query("params")
-	fastMode := c.Query("fast") == "true"
 	autoUpscale := c.Query("auto_upscale") == "true"
-	taskId, taskResultChan, err := discordmd.MidJourneyServiceApp.Imagine(prompt, params, fastMode, autoUpscale)
+	splitGrid := c.Query("split_grid") == "true"
+	priority, _ := strconv.Atoi(c.Query("priority"))
+	mode, err := requestJobMode(c.Query("mode"), c.Query("fast") == "true")
+	if err != nil {
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	if !reserveQuota(c, auth.QuotaImagine) {
+		return
+	}
+	taskId, taskResultChan, err := discordmd.MidJourneyServiceApp.Imagine(prompt, params, mode, autoUpscale, splitGrid, priority, requestKeyName(c))
 	if err != nil {
+		refundQuota(c, auth.QuotaImagine)
 		logger.Errorf("task %s failed: %s", taskId, err.Error())
-		if err == discordmd.ErrTooManyTasks {
-			utils.GinFailedWithMessageAndTaskId(c, 429, taskId, err.Error())
-		} else {
-			utils.GinFailedWithMessageAndTaskId(c, 400, taskId, err.Error())
-		}
+		respondTaskCreationError(c, taskId, err)
 		return
 	}
 	select {
 	case <-time.After(60 * time.Minute):
+		discardTaskResult(taskResultChan)
 		logger.Infof("task %s timeout", taskId)
 		utils.GinFailedWithMessageAndTaskId(c, 408, taskId, "timeout")
 	case taskResult := <-taskResultChan:
@@ -97,8 +159,11 @@ func GenerationImageFromGetRequest(c *gin.Context) {
 			Status:  "completed",
 			Message: taskResult.Message,
 			Payload: model.GenerationTaskResponsePayload{
-				ImageURLs:      payload.ImageURLs,
-				OriginImageURL: payload.OriginImageURL,
+				ImageURLs:              payload.ImageURLs,
+				OriginImageURL:         payload.OriginImageURL,
+				MirroredImageURLs:      payload.MirroredImageURLs,
+				MirroredOriginImageURL: payload.MirroredOriginImageURL,
+				SplitImageURLs:         payload.SplitImageURLs,
 			},
 		})
 	}
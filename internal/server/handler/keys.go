@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/auth"
+	"github.com/haojie06/midjourney-http/internal/model"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+func ListAPIKeys(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"keys": auth.KeyManagerApp.ListKeys(),
+	})
+}
+
+// 添加 key, 返回的明文 key 之后无法再次获取
+func CreateAPIKey(c *gin.Context) {
+	var req model.CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	key, info, err := auth.KeyManagerApp.AddKey(auth.KeyConfig{
+		Name:              req.Name,
+		Key:               req.Key,
+		Scopes:            req.Scopes,
+		ExpiresAt:         req.ExpiresAt,
+		RequestsPerMinute: req.RequestsPerMinute,
+		DailyQuotas:       req.DailyQuotas,
+	})
+	if err != nil {
+		if errors.Is(err, auth.ErrKeyNameExists) || errors.Is(err, auth.ErrKeyExists) {
+			utils.GinFailedWithMessage(c, 409, err.Error())
+		} else {
+			utils.GinFailedWithMessage(c, 400, err.Error())
+		}
+		return
+	}
+	c.JSON(200, gin.H{
+		"key":  key,
+		"info": info,
+	})
+}
+
+func RevokeAPIKey(c *gin.Context) {
+	if err := auth.KeyManagerApp.RevokeKey(c.Param("name")); err != nil {
+		if errors.Is(err, auth.ErrKeyNotFound) {
+			utils.GinFailedWithMessage(c, 404, err.Error())
+		} else {
+			utils.GinFailedWithMessage(c, 500, err.Error())
+		}
+		return
+	}
+	c.JSON(200, gin.H{
+		"message": "revoked",
+	})
+}
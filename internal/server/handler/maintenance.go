@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/discordmd"
+	"github.com/haojie06/midjourney-http/internal/model"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+// 查询全局维护模式, idle 为 true 时所有任务都已结束, 可以重新部署
+func GetMaintenance(c *gin.Context) {
+	enabled, idle := discordmd.MidJourneyServiceApp.MaintenanceStatus()
+	c.JSON(200, gin.H{
+		"maintenance": enabled,
+		"idle":        idle,
+		"bots":        discordmd.MidJourneyServiceApp.ListBotStatus(),
+	})
+}
+
+func UpdateMaintenance(c *gin.Context) {
+	var req model.MaintenanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	discordmd.MidJourneyServiceApp.SetMaintenance(req.Enabled)
+	GetMaintenance(c)
+}
+
+// 查询 bot 的维护状态, idle 为 true 时可以安全地替换账号
+func GetBotMaintenance(c *gin.Context) {
+	status, err := discordmd.MidJourneyServiceApp.GetBotStatus(c.Param("uniqueId"))
+	if err != nil {
+		utils.GinFailedWithMessage(c, 404, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{
+		"bot": status,
+	})
+}
+
+func UpdateBotMaintenance(c *gin.Context) {
+	var req model.MaintenanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	status, err := discordmd.MidJourneyServiceApp.SetBotMaintenance(c.Param("uniqueId"), req.Enabled)
+	if err != nil {
+		utils.GinFailedWithMessage(c, 404, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{
+		"bot": status,
+	})
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/discordmd"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+// 获取 bot 当前的 /settings, refresh=true 时重新读取
+func GetBotSettings(c *gin.Context) {
+	uniqueId := c.Param("uniqueId")
+	refresh := c.Query("refresh") == "true"
+	settings, err := discordmd.MidJourneyServiceApp.GetSettings(uniqueId, refresh)
+	if err != nil {
+		if err == discordmd.ErrBotNotFound {
+			utils.GinFailedWithMessage(c, 404, err.Error())
+		} else {
+			utils.GinFailedWithMessage(c, 500, err.Error())
+		}
+		return
+	}
+	c.JSON(200, gin.H{
+		"unique_id": uniqueId,
+		"settings":  settings,
+	})
+}
+
+// 修改 bot 的 /settings, 未提供的字段保持不变
+func UpdateBotSettings(c *gin.Context) {
+	uniqueId := c.Param("uniqueId")
+	var profile discordmd.BotSettingsProfile
+	if err := c.ShouldBindJSON(&profile); err != nil {
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	settings, err := discordmd.MidJourneyServiceApp.UpdateSettings(uniqueId, profile)
+	if err != nil {
+		switch err {
+		case discordmd.ErrBotNotFound:
+			utils.GinFailedWithMessage(c, 404, err.Error())
+		case discordmd.ErrInvalidSettingsProfile:
+			utils.GinFailedWithMessage(c, 400, err.Error())
+		default:
+			utils.GinFailedWithMessage(c, 500, err.Error())
+		}
+		return
+	}
+	c.JSON(200, gin.H{
+		"unique_id": uniqueId,
+		"settings":  settings,
+	})
+}
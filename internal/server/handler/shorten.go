@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/discordmd"
+	"github.com/haojie06/midjourney-http/internal/logger"
+	"github.com/haojie06/midjourney-http/internal/model"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+func CreateShortenTask(c *gin.Context) {
+	var req model.ShortenTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	if req.Prompt == "" {
+		utils.GinFailedWithMessage(c, 400, "prompt is required")
+		return
+	}
+	taskId, resultChan, err := discordmd.MidJourneyServiceApp.Shorten(req.Prompt, req.Priority, requestKeyName(c))
+	if err != nil {
+		respondTaskCreationError(c, taskId, err)
+		return
+	}
+	select {
+	case <-time.After(5 * time.Minute):
+		logger.Warnf("task %s timeout", taskId)
+		utils.GinFailedWithMessageAndTaskId(c, 408, taskId, "timeout")
+		return
+	case result := <-resultChan:
+		if !result.Successful {
+			utils.GinFailedWithMessageAndTaskId(c, 400, taskId, result.Message)
+			return
+		}
+		payload, ok := result.Payload.(discordmd.PromptShortenResultPayload)
+		if !ok {
+			utils.GinFailedWithMessageAndTaskId(c, 400, taskId, "payload type error")
+			return
+		}
+		tokens := make([]model.ShortenToken, 0, len(payload.Tokens))
+		for _, token := range payload.Tokens {
+			tokens = append(tokens, model.ShortenToken{
+				Token:     token.Token,
+				Weight:    token.Weight,
+				Important: token.Important,
+				Removed:   token.Removed,
+			})
+		}
+		c.JSON(200, model.TaskHTTPResponse{
+			TaskId: taskId,
+			Status: "completed",
+			Payload: model.ShortenTaskResponsePayload{
+				Tokens:           tokens,
+				ShortenedPrompts: payload.ShortenedPrompts,
+			},
+		})
+	}
+}
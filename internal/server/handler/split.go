@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/discordmd"
+	"github.com/haojie06/midjourney-http/internal/model"
+	"github.com/haojie06/midjourney-http/internal/storage"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+// 切分已有任务的四宫格, 不会发送 upscale 请求
+func CreateSplitTask(c *gin.Context) {
+	var req model.SplitTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.GinFailedWithMessage(c, 400, err.Error())
+		return
+	}
+	imageURLs, err := discordmd.MidJourneyServiceApp.SplitGrid(req.TaskId, requestKeyName(c))
+	if err != nil {
+		switch err {
+		case discordmd.ErrTaskNotFound:
+			utils.GinFailedWithMessageAndTaskId(c, 404, req.TaskId, err.Error())
+		case discordmd.ErrOriginImageNotReady, storage.ErrStorageNotConfigured:
+			utils.GinFailedWithMessageAndTaskId(c, 400, req.TaskId, err.Error())
+		default:
+			utils.GinFailedWithMessageAndTaskId(c, 500, req.TaskId, err.Error())
+		}
+		return
+	}
+	c.JSON(200, model.TaskHTTPResponse{
+		TaskId: req.TaskId,
+		Status: "completed",
+		Payload: model.SplitTaskResponsePayload{
+			ImageURLs: imageURLs,
+		},
+	})
+}
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/discordmd"
+	"github.com/haojie06/midjourney-http/internal/model"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+// 调用方放弃等待时在后台读取结果, upscale 会复用任务的结果 channel, 未读取的结果会被之后的 upscale 当作自己的结果
+func discardTaskResult(taskResultChan chan discordmd.TaskResult) {
+	go func() {
+		<-taskResultChan
+	}()
+}
+
+func GetTask(c *gin.Context) {
+	taskId := c.Param("id")
+	record, err := discordmd.MidJourneyServiceApp.GetTask(taskId)
+	if err != nil {
+		utils.GinFailedWithMessageAndTaskId(c, 404, taskId, err.Error())
+		return
+	}
+	c.JSON(200, model.TaskHTTPResponse{
+		TaskId:        record.TaskId,
+		Status:        string(record.State),
+		Message:       record.Message,
+		Payload:       record,
+		QueuePosition: discordmd.MidJourneyServiceApp.QueuePosition(taskId),
+	})
+}
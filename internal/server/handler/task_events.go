@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/discordmd"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+// 以 SSE 的形式推送任务的状态、进度与预览图, 任务结束后关闭连接
+func GetTaskEvents(c *gin.Context) {
+	taskId := c.Param("id")
+	record, events, cancel, err := discordmd.MidJourneyServiceApp.SubscribeTask(taskId)
+	if err != nil {
+		utils.GinFailedWithMessageAndTaskId(c, 404, taskId, err.Error())
+		return
+	}
+	defer cancel()
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	// 先推送当前状态, 已结束的任务直接返回结果
+	snapshot := discordmd.TaskEvent{
+		Type:           discordmd.TaskEventTypeState,
+		TaskId:         record.TaskId,
+		State:          record.State,
+		Progress:       record.Progress,
+		ProgressStatus: record.ProgressStatus,
+		Message:        record.Message,
+		Finished:       record.FinishedAt != nil,
+		CreatedAt:      time.Now(),
+	}
+	if len(record.PreviewImageURLs) > 0 {
+		snapshot.PreviewImageURL = record.PreviewImageURLs[len(record.PreviewImageURLs)-1]
+	}
+	if snapshot.Finished {
+		snapshot.Type = discordmd.TaskEventTypeResult
+		snapshot.Result = record.Result
+	}
+	c.SSEvent(string(snapshot.Type), snapshot)
+	c.Writer.Flush()
+	if snapshot.Finished {
+		return
+	}
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-heartbeat.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(string(event.Type), event)
+			return !event.Finished
+		}
+	})
+}
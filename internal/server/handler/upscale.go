@@ -1,9 +1,11 @@
 package handler
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/auth"
 	"github.com/haojie06/midjourney-http/internal/discordmd"
 	"github.com/haojie06/midjourney-http/internal/logger"
 	"github.com/haojie06/midjourney-http/internal/model"
@@ -16,49 +18,72 @@ func CreateUpscaleTask(c *gin.Context) {
 		utils.GinFailedWithMessage(c, 400, err.Error())
 		return
 	}
-	taskResultChan, err := discordmd.MidJourneyServiceApp.Upscale(req.TaskId, req.Index)
+	if !reserveQuota(c, auth.QuotaUpscale) {
+		return
+	}
+	taskResultChan, err := discordmd.MidJourneyServiceApp.Upscale(req.TaskId, req.Index, req.Priority, requestKeyName(c))
 	if err != nil {
-		utils.GinFailedWithMessageAndTaskId(c, 400, req.TaskId, err.Error())
+		refundQuota(c, auth.QuotaUpscale)
+		respondTaskCreationError(c, req.TaskId, err)
 		return
 	}
 	select {
 	case <-time.After(30 * time.Minute):
+		discardTaskResult(taskResultChan)
 		logger.Warnf("task %s timeout", req.TaskId)
 		utils.GinFailedWithMessageAndTaskId(c, 408, req.TaskId, "timeout")
 		return
 	case taskResult := <-taskResultChan:
-		if !taskResult.Successful {
-			utils.GinFailedWithMessageAndTaskId(c, 400, req.TaskId, taskResult.Message)
-			return
+		status, response := buildUpscaleResponse(req.TaskId, taskResult)
+		c.JSON(status, response)
+		return
+	}
+}
+
+func buildUpscaleResponse(taskId string, result discordmd.TaskResult) (status int, response model.TaskHTTPResponse) {
+	if !result.Successful {
+		return 400, model.TaskHTTPResponse{
+			TaskId:  taskId,
+			Status:  "failed",
+			Message: result.Message,
 		}
-		payload, ok := taskResult.Payload.(discordmd.ImageUpscaleResultPayload)
-		if !ok {
-			utils.GinFailedWithMessageAndTaskId(c, 400, req.TaskId, "payload type error")
-			return
+	}
+	payload, ok := result.Payload.(discordmd.ImageUpscaleResultPayload)
+	if !ok {
+		return 400, model.TaskHTTPResponse{
+			TaskId:  taskId,
+			Status:  "failed",
+			Message: "payload type error",
 		}
-		logger.Infof("task %s upscale %s completed", req.TaskId, payload.Index)
-		c.JSON(200, model.TaskHTTPResponse{
-			TaskId: req.TaskId,
-			Status: "completed",
-			Payload: model.UpscaleTaskResponsePayload{
-				ImageURL: payload.ImageURL,
-				Index:    payload.Index,
-			},
-		})
-		return
+	}
+	logger.Infof("task %s upscale %s completed", taskId, payload.Index)
+	return 200, model.TaskHTTPResponse{
+		TaskId: taskId,
+		Status: "completed",
+		Payload: model.UpscaleTaskResponsePayload{
+			ImageURL:         payload.ImageURL,
+			Index:            payload.Index,
+			MirroredImageURL: payload.MirroredImageURL,
+		},
 	}
 }
 
 func UpscaleImageFromGetRequest(c *gin.Context) {
 	taskId := c.Query("task_id")
 	upscaleIndex := c.Query("index")
-	resultChan, err := discordmd.MidJourneyServiceApp.Upscale(taskId, upscaleIndex)
+	priority, _ := strconv.Atoi(c.Query("priority"))
+	if !reserveQuota(c, auth.QuotaUpscale) {
+		return
+	}
+	resultChan, err := discordmd.MidJourneyServiceApp.Upscale(taskId, upscaleIndex, priority, requestKeyName(c))
 	if err != nil {
-		utils.GinFailedWithMessageAndTaskId(c, 400, taskId, err.Error())
+		refundQuota(c, auth.QuotaUpscale)
+		respondTaskCreationError(c, taskId, err)
 		return
 	}
 	select {
 	case <-time.After(10 * time.Minute):
+		discardTaskResult(resultChan)
 		// discordmd.MidJourneyServiceApp.RemoveTaskRuntime(taskId)
 		logger.Warnf("task %s timeout", taskId)
 		utils.GinFailedWithMessageAndTaskId(c, 408, taskId, "timeout")
@@ -81,8 +106,9 @@ func UpscaleImageFromGetRequest(c *gin.Context) {
 			TaskId: taskId,
 			Status: "completed",
 			Payload: model.UpscaleTaskResponsePayload{
-				ImageURL: payload.ImageURL,
-				Index:    payload.Index,
+				ImageURL:         payload.ImageURL,
+				Index:            payload.Index,
+				MirroredImageURL: payload.MirroredImageURL,
 			},
 		})
 		return
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/auth"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+// 查询 api key 当日的任务数量与配额, admin 可以看到所有 key
+func GetUsage(c *gin.Context) {
+	apiKey, exist := requestAPIKey(c)
+	if exist && !apiKey.HasScope(auth.ScopeAdmin) {
+		c.JSON(200, gin.H{
+			"usages": []auth.KeyUsage{apiKey.Usage()},
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"usages": auth.KeyManagerApp.Usage(),
+	})
+}
+
+// 创建任务前预占当前 api key 的配额, 配额用完时返回 429
+func reserveQuota(c *gin.Context, quotaType string) bool {
+	apiKey, exist := requestAPIKey(c)
+	if !exist {
+		return true
+	}
+	if err := apiKey.Reserve(quotaType); err != nil {
+		utils.GinFailedWithMessage(c, 429, err.Error())
+		return false
+	}
+	return true
+}
+
+// 任务没有创建成功时归还配额
+func refundQuota(c *gin.Context, quotaType string) {
+	if apiKey, exist := requestAPIKey(c); exist {
+		apiKey.Refund(quotaType)
+	}
+}
+
+// 记录在任务上, 用于审计
+func requestKeyName(c *gin.Context) string {
+	if apiKey, exist := requestAPIKey(c); exist {
+		return apiKey.Name()
+	}
+	return ""
+}
+
+func requestAPIKey(c *gin.Context) (*auth.APIKey, bool) {
+	value, exist := c.Get(auth.ContextKey)
+	if !exist {
+		return nil, false
+	}
+	apiKey, ok := value.(*auth.APIKey)
+	return apiKey, ok
+}
@@ -0,0 +1,14 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/webhook"
+)
+
+// 查询 webhook 投递记录, 可以通过 task_id 过滤
+func GetWebhookDeliveries(c *gin.Context) {
+	taskId := c.Query("task_id")
+	c.JSON(200, gin.H{
+		"deliveries": webhook.DispatcherApp.DeliveryLogs(taskId),
+	})
+}
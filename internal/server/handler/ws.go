@@ -0,0 +1,285 @@
+package handler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/haojie06/midjourney-http/internal/auth"
+	"github.com/haojie06/midjourney-http/internal/discordmd"
+	"github.com/haojie06/midjourney-http/internal/logger"
+	"github.com/haojie06/midjourney-http/internal/model"
+	"github.com/haojie06/midjourney-http/internal/utils"
+)
+
+const (
+	wsAuthTimeout  = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = 30 * time.Second
+	wsWriteTimeout = 10 * time.Second
+)
+
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// 一个连接上可以同时提交多个任务, 写入需要加锁
+type wsConnection struct {
+	conn *websocket.Conn
+
+	writeLock sync.Mutex
+
+	closed chan struct{}
+
+	closeOnce sync.Once
+
+	apiKey *auth.APIKey
+}
+
+func (ws *wsConnection) send(message model.WSMessage) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return ws.conn.WriteJSON(message)
+}
+
+func (ws *wsConnection) sendError(requestId, taskId, message string) {
+	ws.send(model.WSMessage{
+		Type:      "error",
+		RequestId: requestId,
+		TaskId:    taskId,
+		Status:    "failed",
+		Message:   message,
+	})
+}
+
+func (ws *wsConnection) close() {
+	ws.closeOnce.Do(func() {
+		close(ws.closed)
+		ws.conn.Close()
+	})
+}
+
+// 客户端可以在握手时通过 API-KEY 请求头认证, 也可以在连接后发送 auth 消息, 不接受 url 中的 key, 避免被记录到日志中
+func ServeWebSocket() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestKey := c.GetHeader("API-KEY")
+		conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			logger.Warnf("failed to upgrade websocket: %s", err.Error())
+			return
+		}
+		ws := &wsConnection{
+			conn:   conn,
+			closed: make(chan struct{}),
+		}
+		defer ws.close()
+		apiKey, authenticated := auth.KeyManagerApp.Authenticate(requestKey)
+		ws.apiKey = apiKey
+		if authenticated {
+			ws.send(model.WSMessage{Type: "authenticated"})
+		}
+
+		conn.SetReadDeadline(time.Now().Add(wsAuthTimeout))
+		conn.SetPongHandler(func(string) error {
+			conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+			return nil
+		})
+		go ws.keepalive()
+		for {
+			var req model.WSRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					logger.Warnf("websocket closed: %s", err.Error())
+				}
+				return
+			}
+			if !authenticated {
+				apiKey, exist := auth.KeyManagerApp.Authenticate(req.APIKey)
+				if req.Type != "auth" || !exist {
+					ws.sendError(req.RequestId, "", "Invalid API key")
+					return
+				}
+				authenticated = true
+				ws.apiKey = apiKey
+				conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+				ws.send(model.WSMessage{Type: "authenticated", RequestId: req.RequestId})
+				continue
+			}
+			conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+			// 每条消息都计入 api key 的请求频率
+			if allowed, retryAfter := ws.apiKey.Allow(); !allowed {
+				ws.sendError(req.RequestId, req.TaskId, fmt.Sprintf("rate limit exceeded, retry after %s", retryAfter.Round(time.Second)))
+				continue
+			}
+			ws.handleRequest(req)
+		}
+	}
+}
+
+func (ws *wsConnection) keepalive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ws.closed:
+			return
+		case <-ticker.C:
+			ws.writeLock.Lock()
+			err := ws.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			ws.writeLock.Unlock()
+			if err != nil {
+				ws.close()
+				return
+			}
+		}
+	}
+}
+
+func (ws *wsConnection) handleRequest(req model.WSRequest) {
+	switch req.Type {
+	case "auth":
+		ws.send(model.WSMessage{Type: "authenticated", RequestId: req.RequestId})
+	case "imagine":
+		if !ws.requireScope(req, auth.ScopeImagine) {
+			return
+		}
+		mode, err := requestJobMode(req.Mode, req.FastMode)
+		if err != nil {
+			ws.sendError(req.RequestId, "", err.Error())
+			return
+		}
+		if err := ws.apiKey.Reserve(auth.QuotaImagine); err != nil {
+			ws.sendError(req.RequestId, "", err.Error())
+			return
+		}
+		taskId, taskResultChan, err := discordmd.MidJourneyServiceApp.Imagine(req.Prompt, req.Params, mode, req.AutoUpscale, req.SplitGrid, req.Priority, ws.apiKey.Name())
+		if err != nil {
+			ws.apiKey.Refund(auth.QuotaImagine)
+			ws.sendError(req.RequestId, taskId, err.Error())
+			return
+		}
+		ws.send(model.WSMessage{Type: "ack", RequestId: req.RequestId, TaskId: taskId, Status: "pending", QueueDepth: discordmd.MidJourneyServiceApp.QueueDepth(), QueuePosition: discordmd.MidJourneyServiceApp.QueuePosition(taskId)})
+		go ws.watchTask(req.RequestId, taskId, taskResultChan, 60*time.Minute, func(result discordmd.TaskResult) model.TaskHTTPResponse {
+			_, response := buildGenerationResponse(result)
+			return response
+		})
+	case "upscale":
+		if !ws.requireScope(req, auth.ScopeUpscale) {
+			return
+		}
+		if err := ws.apiKey.Reserve(auth.QuotaUpscale); err != nil {
+			ws.sendError(req.RequestId, req.TaskId, err.Error())
+			return
+		}
+		taskResultChan, err := discordmd.MidJourneyServiceApp.Upscale(req.TaskId, req.Index, req.Priority, ws.apiKey.Name())
+		if err != nil {
+			ws.apiKey.Refund(auth.QuotaUpscale)
+			ws.sendError(req.RequestId, req.TaskId, err.Error())
+			return
+		}
+		ws.send(model.WSMessage{Type: "ack", RequestId: req.RequestId, TaskId: req.TaskId, Status: "pending", QueuePosition: discordmd.MidJourneyServiceApp.QueuePosition(req.TaskId)})
+		go ws.watchTask(req.RequestId, req.TaskId, taskResultChan, 30*time.Minute, func(result discordmd.TaskResult) model.TaskHTTPResponse {
+			_, response := buildUpscaleResponse(req.TaskId, result)
+			return response
+		})
+	case "describe":
+		if !ws.requireScope(req, auth.ScopeDescribe) {
+			return
+		}
+		content, err := base64.StdEncoding.DecodeString(req.Image)
+		if err != nil || len(content) == 0 {
+			ws.sendError(req.RequestId, "", "image should be base64 encoded")
+			return
+		}
+		filename := filepath.Base(req.Filename)
+		if req.Filename == "" {
+			filename = "image.png"
+		}
+		file, err := utils.NewFileHeader(filename, content)
+		if err != nil {
+			ws.sendError(req.RequestId, "", err.Error())
+			return
+		}
+		if err := ws.apiKey.Reserve(auth.QuotaDescribe); err != nil {
+			ws.sendError(req.RequestId, "", err.Error())
+			return
+		}
+		taskId, taskResultChan, err := discordmd.MidJourneyServiceApp.Describe(file, file.Filename, int(file.Size), req.Priority, ws.apiKey.Name())
+		if err != nil {
+			ws.apiKey.Refund(auth.QuotaDescribe)
+			ws.sendError(req.RequestId, taskId, err.Error())
+			return
+		}
+		ws.send(model.WSMessage{Type: "ack", RequestId: req.RequestId, TaskId: taskId, Status: "pending", QueueDepth: discordmd.MidJourneyServiceApp.QueueDepth(), QueuePosition: discordmd.MidJourneyServiceApp.QueuePosition(taskId)})
+		go ws.watchTask(req.RequestId, taskId, taskResultChan, 5*time.Minute, func(result discordmd.TaskResult) model.TaskHTTPResponse {
+			_, response := buildDescribeResponse(result)
+			return response
+		})
+	default:
+		ws.sendError(req.RequestId, req.TaskId, "unknown request type: "+req.Type)
+	}
+}
+
+func (ws *wsConnection) requireScope(req model.WSRequest, scope string) bool {
+	if ws.apiKey.HasScope(scope) {
+		return true
+	}
+	ws.sendError(req.RequestId, req.TaskId, "API key does not have scope: "+scope)
+	return false
+}
+
+// 转发任务的状态与进度, 拿到结果后发送 result 消息
+func (ws *wsConnection) watchTask(requestId, taskId string, taskResultChan chan discordmd.TaskResult, timeout time.Duration, buildResponse func(discordmd.TaskResult) model.TaskHTTPResponse) {
+	_, events, cancel, err := discordmd.MidJourneyServiceApp.SubscribeTask(taskId)
+	if err != nil {
+		events = make(chan discordmd.TaskEvent)
+		cancel = func() {}
+	}
+	defer cancel()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-ws.closed:
+			// 连接断开后任务仍会继续, 结果可以通过 /task/:id 查询
+			discardTaskResult(taskResultChan)
+			return
+		case <-deadline:
+			ws.sendError(requestId, taskId, "timeout")
+			discardTaskResult(taskResultChan)
+			return
+		case event, ok := <-events:
+			if !ok {
+				// 结果通过 taskResultChan 发送
+				events = nil
+				continue
+			}
+			if event.Type == discordmd.TaskEventTypeResult {
+				continue
+			}
+			ws.send(model.WSMessage{
+				Type:      string(event.Type),
+				RequestId: requestId,
+				TaskId:    taskId,
+				Status:    string(event.State),
+				Payload:   event,
+			})
+		case result := <-taskResultChan:
+			response := buildResponse(result)
+			ws.send(model.WSMessage{
+				Type:      "result",
+				RequestId: requestId,
+				TaskId:    taskId,
+				Status:    response.Status,
+				Message:   response.Message,
+				Payload:   response.Payload,
+			})
+			return
+		}
+	}
+}
@@ -1,51 +1,155 @@
 package server
 
 import (
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/pprof"
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
+	"github.com/haojie06/midjourney-http/internal/auth"
 	"github.com/haojie06/midjourney-http/internal/logger"
 	"github.com/haojie06/midjourney-http/internal/server/handler"
+	"github.com/haojie06/midjourney-http/internal/storage"
 )
 
-func Start(host, port, apiKey string) {
-	router := InnitRouter(apiKey)
+func Start(host, port string) {
+	router := InnitRouter()
 	if err := router.Run(host + ":" + port); err != nil {
 		panic(err)
 	}
 }
 
-func PermissionCheckMiddleware(apiKey string) gin.HandlerFunc {
+func PermissionCheckMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		requestKey := c.GetHeader("API-KEY")
-		if requestKey != apiKey {
+		apiKey, exist := auth.KeyManagerApp.Authenticate(requestKey)
+		if !exist {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"message": "Invalid API key",
 			})
 			return
 		}
+		c.Set(auth.ContextKey, apiKey)
 		c.Next()
 	}
 }
 
-func InnitRouter(apiKey string) *gin.Engine {
+// 需要在 PermissionCheckMiddleware 之后使用, 查询任务状态的接口不经过这里, 轮询不会占用创建任务的频率
+func RateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := c.Get(auth.ContextKey)
+		apiKey, ok := value.(*auth.APIKey)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"message": "Invalid API key",
+			})
+			return
+		}
+		if allowed, retryAfter := apiKey.Allow(); !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"message": "Rate limit exceeded",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// SSE 的路由, 浏览器的 EventSource 无法设置请求头, 只有这里允许通过 api_key 参数传入
+const taskEventsPath = "/task/:id/events"
+
+// 需要在 ginzap 之前使用, 从 URL 中移除 api_key, 避免 key 被写入访问日志
+func QueryAPIKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := c.Request.URL.Query()
+		if query.Has("api_key") {
+			if c.FullPath() == taskEventsPath && c.GetHeader("API-KEY") == "" {
+				c.Request.Header.Set("API-KEY", query.Get("api_key"))
+			}
+			query.Del("api_key")
+			c.Request.URL.RawQuery = query.Encode()
+		}
+		c.Next()
+	}
+}
+
+// 需要在 PermissionCheckMiddleware 之后使用
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := c.Get(auth.ContextKey)
+		if apiKey, ok := value.(*auth.APIKey); !ok || !apiKey.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"message": "API key does not have scope: " + scope,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+func InnitRouter() *gin.Engine {
 	router := gin.New()
 	router.Use(ginzap.RecoveryWithZap(logger.ZapLogger, true))
+	router.Use(QueryAPIKeyMiddleware())
 	router.Use(ginzap.Ginzap(logger.ZapLogger, time.RFC3339Nano, true))
 	router.Use(cors.Default())
 	pprof.Register(router)
 
-	apiGroup := router.Group("", PermissionCheckMiddleware(apiKey))
-	apiGroup.POST("/image-task", handler.CreateGenerationTask)
-	apiGroup.GET("/image", handler.GenerationImageFromGetRequest)
+	// websocket 连接建立后才认证, 不经过 PermissionCheckMiddleware
+	router.GET("/ws", handler.ServeWebSocket())
+	// 转存到本地的图片需要公开访问
+	if local := storage.MirrorApp.LocalStorage(); local != nil {
+		router.Static("/mirror", local.Dir)
+	}
+
+	router.GET(taskEventsPath, PermissionCheckMiddleware(), handler.GetTaskEvents)
+
+	authGroup := router.Group("", PermissionCheckMiddleware())
+	authGroup.GET("/task/:id", handler.GetTask)
+	authGroup.GET("/webhook/deliveries", handler.GetWebhookDeliveries)
+	authGroup.GET("/usage", handler.GetUsage)
+
+	apiGroup := authGroup.Group("", RateLimitMiddleware())
+	apiGroup.POST("/image-task", RequireScope(auth.ScopeImagine), handler.CreateGenerationTask)
+	apiGroup.GET("/image", RequireScope(auth.ScopeImagine), handler.GenerationImageFromGetRequest)
+
+	apiGroup.POST("/upscale-task", RequireScope(auth.ScopeUpscale), handler.CreateUpscaleTask)
+	apiGroup.GET("/upscale", RequireScope(auth.ScopeUpscale), handler.UpscaleImageFromGetRequest)
+
+	apiGroup.POST("/variation-task", RequireScope(auth.ScopeImagine), handler.CreateVariationTask)
+	apiGroup.POST("/reroll-task", RequireScope(auth.ScopeImagine), handler.CreateRerollTask)
+	apiGroup.POST("/outpaint-task", RequireScope(auth.ScopeImagine), handler.CreateOutpaintTask)
+
+	apiGroup.POST("/describe-task", RequireScope(auth.ScopeDescribe), handler.CreateDescribeTask)
+
+	apiGroup.POST("/blend-task", RequireScope(auth.ScopeImagine), handler.CreateBlendTask)
+
+	apiGroup.POST("/shorten-task", RequireScope(auth.ScopeImagine), handler.CreateShortenTask)
+
+	apiGroup.POST("/split", RequireScope(auth.ScopeImagine), handler.CreateSplitTask)
+
+	adminGroup := apiGroup.Group("", RequireScope(auth.ScopeAdmin))
+	adminGroup.GET("/bots", handler.ListBots)
+	adminGroup.POST("/bots", handler.AddBot)
+	adminGroup.DELETE("/bots/:uniqueId", handler.RemoveBot)
+	adminGroup.POST("/bots/:uniqueId/enable", handler.EnableBot)
+	adminGroup.POST("/bots/:uniqueId/disable", handler.DisableBot)
+	adminGroup.GET("/bots/:uniqueId/maintenance", handler.GetBotMaintenance)
+	adminGroup.PUT("/bots/:uniqueId/maintenance", handler.UpdateBotMaintenance)
 
-	apiGroup.POST("/upscale-task", handler.CreateUpscaleTask)
-	apiGroup.GET("/upscale", handler.UpscaleImageFromGetRequest)
+	adminGroup.GET("/maintenance", handler.GetMaintenance)
+	adminGroup.PUT("/maintenance", handler.UpdateMaintenance)
+	adminGroup.GET("/bots/:uniqueId/info", handler.GetBotAccountInfo)
+	adminGroup.GET("/bots/:uniqueId/settings", handler.GetBotSettings)
+	adminGroup.PUT("/bots/:uniqueId/settings", handler.UpdateBotSettings)
 
-	apiGroup.POST("/describe-task", handler.CreateDescribeTask)
+	adminGroup.GET("/admin/keys", handler.ListAPIKeys)
+	adminGroup.POST("/admin/keys", handler.CreateAPIKey)
+	adminGroup.DELETE("/admin/keys/:name", handler.RevokeAPIKey)
 	return router
 }
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type LocalConfig struct {
+	Dir string `mapstructure:"dir"`
+
+	BaseURL string `mapstructure:"baseURL"` // 对外访问的地址, 例如 http://127.0.0.1:9000/mirror
+}
+
+// 保存在本地目录中, 由服务的 /mirror 路由提供访问
+type LocalStorage struct {
+	Dir string
+
+	baseURL string
+}
+
+func NewLocalStorage(config LocalConfig) *LocalStorage {
+	if config.Dir == "" {
+		config.Dir = "data/images"
+	}
+	if config.BaseURL == "" {
+		config.BaseURL = "/mirror"
+	}
+	return &LocalStorage{
+		Dir:     config.Dir,
+		baseURL: strings.TrimSuffix(config.BaseURL, "/"),
+	}
+}
+
+func (s *LocalStorage) Put(key, contentType string, content []byte) (url string, err error) {
+	filePath := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if err = os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return
+	}
+	if err = os.WriteFile(filePath, content, 0644); err != nil {
+		return
+	}
+	return s.baseURL + "/" + key, nil
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type S3Config struct {
+	Endpoint string `mapstructure:"endpoint"` // 例如 https://s3.us-east-1.amazonaws.com, 兼容 minio、r2 等
+
+	Region string `mapstructure:"region"`
+
+	Bucket string `mapstructure:"bucket"`
+
+	AccessKeyId string `mapstructure:"accessKeyId"`
+
+	SecretAccessKey string `mapstructure:"secretAccessKey"`
+
+	PublicURL string `mapstructure:"publicURL"` // 对外访问的地址, 例如 cdn 域名, 为空时使用 endpoint
+
+	PathStyle bool `mapstructure:"pathStyle"` // minio 等需要使用 path style
+}
+
+// 兼容 s3 协议的对象存储, 使用 aws signature v4 签名, 不依赖 aws sdk
+type S3Storage struct {
+	config S3Config
+
+	endpoint *url.URL
+
+	client *http.Client
+}
+
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket are required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Storage{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+func (s *S3Storage) Put(key, contentType string, content []byte) (objectURL string, err error) {
+	host := s.endpoint.Host
+	objectPath := "/" + awsURIEncode(key)
+	if s.config.PathStyle {
+		objectPath = "/" + s.config.Bucket + objectPath
+	} else {
+		host = s.config.Bucket + "." + host
+	}
+	request, err := http.NewRequest("PUT", s.endpoint.Scheme+"://"+host+objectPath, bytes.NewReader(content))
+	if err != nil {
+		return
+	}
+	request.Header.Set("Content-Type", contentType)
+	s.sign(request, host, objectPath, content, time.Now().UTC())
+	response, err := s.client.Do(request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return "", fmt.Errorf("failed to put object %s, status code: %d, body: %s", key, response.StatusCode, string(body))
+	}
+	if s.config.PublicURL != "" {
+		return strings.TrimSuffix(s.config.PublicURL, "/") + "/" + awsURIEncode(key), nil
+	}
+	return s.endpoint.Scheme + "://" + host + objectPath, nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3Storage) sign(request *http.Request, host, canonicalURI string, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+	request.Host = host
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("content-type:%s\nhost:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+		strings.TrimSpace(request.Header.Get("Content-Type")), host, payloadHash, amzDate)
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		canonicalURI,
+		"", // query string
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.config.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+	signingKey := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, s.config.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// 除 A-Z a-z 0-9 - _ . ~ 以外的字符都需要编码, object key 中的 / 保留
+func awsURIEncode(s string) string {
+	var builder strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || b == '/' {
+			builder.WriteByte(b)
+			continue
+		}
+		fmt.Fprintf(&builder, "%%%02X", b)
+	}
+	return builder.String()
+}
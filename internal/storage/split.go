@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"path"
+	"strings"
+
+	"github.com/haojie06/midjourney-http/internal/logger"
+)
+
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+// 将 2x2 的四宫格切分为四张图片并保存, 顺序与 U1-U4 一致(左上、右上、左下、右下)
+func (m *Mirror) SplitGrid(prefix, imageURL string) (imageURLs []string, err error) {
+	if !m.Enabled() {
+		return nil, ErrStorageNotConfigured
+	}
+	content, _, err := m.download(imageURL)
+	if err != nil {
+		return
+	}
+	return m.splitGrid(prefix, imageURL, content)
+}
+
+// 转存四宫格并切分, 只下载一次; 转存成功但切分失败时 mirroredURL 仍然有效
+func (m *Mirror) MirrorGrid(prefix, imageURL string) (mirroredURL string, splitImageURLs []string, err error) {
+	if !m.Enabled() {
+		return "", nil, ErrStorageNotConfigured
+	}
+	content, contentType, err := m.download(imageURL)
+	if err != nil {
+		return
+	}
+	if mirroredURL, err = m.put(prefix, imageURL, contentType, content); err != nil {
+		return
+	}
+	splitImageURLs, err = m.splitGrid(prefix, imageURL, content)
+	return
+}
+
+// 切分失败时不返回已经保存的部分图片
+func (m *Mirror) splitGrid(prefix, imageURL string, content []byte) (imageURLs []string, err error) {
+	grid, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode grid image: %w", err)
+	}
+	cropper, ok := grid.(subImager)
+	if !ok {
+		return nil, fmt.Errorf("unsupported image type %T", grid)
+	}
+	bounds := grid.Bounds()
+	width, height := bounds.Dx()/2, bounds.Dy()/2
+	fileName := fileNameFromURL(imageURL)
+	baseName := strings.TrimSuffix(fileName, path.Ext(fileName))
+	imageURLs = make([]string, 0, 4)
+	for i := 0; i < 4; i++ {
+		minPoint := bounds.Min.Add(image.Pt((i%2)*width, (i/2)*height))
+		quadrant := cropper.SubImage(image.Rectangle{Min: minPoint, Max: minPoint.Add(image.Pt(width, height))})
+		buffer := &bytes.Buffer{}
+		if err = png.Encode(buffer, quadrant); err != nil {
+			return nil, err
+		}
+		key := path.Join(prefix, fmt.Sprintf("%s_%d.png", baseName, i+1))
+		var splitURL string
+		if splitURL, err = m.storage.Put(key, "image/png", buffer.Bytes()); err != nil {
+			return nil, err
+		}
+		imageURLs = append(imageURLs, splitURL)
+	}
+	logger.Infof("grid %s split into %d images", imageURL, len(imageURLs))
+	return
+}
@@ -0,0 +1,129 @@
+// storage - 将 discord cdn 上的图片转存到自己的存储中, discord 的链接会过期且部分地区无法访问
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/haojie06/midjourney-http/internal/logger"
+)
+
+var (
+	MirrorApp               *Mirror
+	ErrStorageNotConfigured = fmt.Errorf("storage is not configured")
+)
+
+func init() {
+	MirrorApp, _ = NewMirror(Config{})
+}
+
+type Config struct {
+	Type string `mapstructure:"type"` // local, s3, 为空时不转存
+
+	Timeout time.Duration `mapstructure:"timeout"` // 下载图片的超时时间
+
+	Local LocalConfig `mapstructure:"local"`
+
+	S3 S3Config `mapstructure:"s3"`
+}
+
+// Storage 保存文件并返回可以公开访问的链接
+type Storage interface {
+	Put(key, contentType string, content []byte) (url string, err error)
+}
+
+type Mirror struct {
+	storage Storage
+
+	client *http.Client
+}
+
+func NewMirror(config Config) (*Mirror, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	mirror := &Mirror{
+		client: &http.Client{Timeout: config.Timeout},
+	}
+	switch config.Type {
+	case "":
+	case "local":
+		mirror.storage = NewLocalStorage(config.Local)
+	case "s3":
+		s3Storage, err := NewS3Storage(config.S3)
+		if err != nil {
+			return mirror, err
+		}
+		mirror.storage = s3Storage
+	default:
+		return mirror, fmt.Errorf("unknown storage type: %s", config.Type)
+	}
+	return mirror, nil
+}
+
+func (m *Mirror) Enabled() bool {
+	return m != nil && m.storage != nil
+}
+
+// 本地存储的目录, 用于注册静态文件路由, 其他存储返回空
+func (m *Mirror) LocalStorage() *LocalStorage {
+	if m == nil {
+		return nil
+	}
+	local, _ := m.storage.(*LocalStorage)
+	return local
+}
+
+// 下载图片并保存到 prefix 下, 文件名与 discord 上的附件名一致
+func (m *Mirror) MirrorImage(prefix, imageURL string) (mirroredURL string, err error) {
+	if !m.Enabled() {
+		return "", ErrStorageNotConfigured
+	}
+	content, contentType, err := m.download(imageURL)
+	if err != nil {
+		return
+	}
+	return m.put(prefix, imageURL, contentType, content)
+}
+
+func (m *Mirror) put(prefix, imageURL, contentType string, content []byte) (mirroredURL string, err error) {
+	if mirroredURL, err = m.storage.Put(path.Join(prefix, fileNameFromURL(imageURL)), contentType, content); err != nil {
+		return
+	}
+	logger.Infof("image %s mirrored to %s", imageURL, mirroredURL)
+	return
+}
+
+func (m *Mirror) download(imageURL string) (content []byte, contentType string, err error) {
+	response, err := m.client.Get(imageURL)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("failed to download %s, status code: %d", imageURL, response.StatusCode)
+	}
+	buffer := &bytes.Buffer{}
+	if _, err = io.Copy(buffer, response.Body); err != nil {
+		return
+	}
+	content = buffer.Bytes()
+	contentType = response.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	return
+}
+
+func fileNameFromURL(imageURL string) string {
+	parsedURL, err := url.Parse(imageURL)
+	if err != nil {
+		return path.Base(imageURL)
+	}
+	return path.Base(parsedURL.Path)
+}
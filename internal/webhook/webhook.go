@@ -0,0 +1,189 @@
+// webhook - 任务结果的 webhook 推送, 支持签名、失败重试以及投递记录
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/haojie06/midjourney-http/internal/logger"
+)
+
+const (
+	SignatureHeader  = "X-Signature"
+	TimestampHeader  = "X-Timestamp"
+	DeliveryIdHeader = "X-Delivery-Id"
+)
+
+var (
+	DispatcherApp *Dispatcher
+)
+
+func init() {
+	DispatcherApp = NewDispatcher(Config{})
+}
+
+type Config struct {
+	Secret string `mapstructure:"secret"` // hmac-sha256 签名密钥, 为空时不签名
+
+	MaxRetries *int `mapstructure:"maxRetries"` // 失败后的重试次数, 不包括第一次投递, 未配置时为 5, 0 表示不重试
+
+	InitialBackoff time.Duration `mapstructure:"initialBackoff"`
+
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	MaxDeliveryLogs int `mapstructure:"maxDeliveryLogs"` // 内存中保留的投递记录数量
+}
+
+// 每一次投递尝试都会生成一条记录
+type DeliveryAttempt struct {
+	DeliveryId string    `json:"delivery_id"`
+	TaskId     string    `json:"task_id"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error,omitempty"`
+	Successful bool      `json:"successful"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type Dispatcher struct {
+	config Config
+
+	client *http.Client
+
+	deliveryLogs []DeliveryAttempt
+
+	logLock sync.RWMutex
+}
+
+func NewDispatcher(config Config) *Dispatcher {
+	if config.MaxRetries == nil || *config.MaxRetries < 0 {
+		maxRetries := 5
+		if config.MaxRetries != nil {
+			maxRetries = 0
+		}
+		config.MaxRetries = &maxRetries
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = 2 * time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.MaxDeliveryLogs <= 0 {
+		config.MaxDeliveryLogs = 1000
+	}
+	return &Dispatcher{
+		config:       config,
+		client:       &http.Client{Timeout: config.Timeout},
+		deliveryLogs: make([]DeliveryAttempt, 0),
+	}
+}
+
+// 异步推送, 失败时按照指数退避重试
+func (d *Dispatcher) Dispatch(url, taskId string, body interface{}) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		logger.Errorf("task %s failed to marshal webhook body: %s", taskId, err.Error())
+		return
+	}
+	go d.deliver(url, taskId, payload)
+}
+
+func (d *Dispatcher) deliver(url, taskId string, payload []byte) {
+	deliveryId := uuid.New().String()
+	backoff := d.config.InitialBackoff
+	maxAttempts := *d.config.MaxRetries + 1
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		statusCode, err := d.post(url, deliveryId, payload)
+		record := DeliveryAttempt{
+			DeliveryId: deliveryId,
+			TaskId:     taskId,
+			URL:        url,
+			Attempt:    attempt,
+			StatusCode: statusCode,
+			Successful: err == nil && statusCode < 300,
+			CreatedAt:  time.Now(),
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		d.appendLog(record)
+		if record.Successful {
+			logger.Infof("task %s webhook delivered to %s, attempt: %d", taskId, url, attempt)
+			return
+		}
+		// 4xx (除 429 外) 说明接收方拒绝, 重试没有意义
+		if err == nil && statusCode >= 400 && statusCode < 500 && statusCode != http.StatusTooManyRequests {
+			logger.Warnf("task %s webhook rejected by %s, status: %d", taskId, url, statusCode)
+			return
+		}
+		logger.Warnf("task %s webhook delivery failed, attempt: %d/%d, status: %d, err: %v", taskId, attempt, maxAttempts, statusCode, err)
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	logger.Errorf("task %s webhook delivery to %s gave up after %d attempts", taskId, url, maxAttempts)
+}
+
+func (d *Dispatcher) post(url, deliveryId string, payload []byte) (statusCode int, err error) {
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(DeliveryIdHeader, deliveryId)
+	request.Header.Set(TimestampHeader, timestamp)
+	if d.config.Secret != "" {
+		request.Header.Set(SignatureHeader, "sha256="+Sign(d.config.Secret, timestamp, payload))
+	}
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	return response.StatusCode, nil
+}
+
+func (d *Dispatcher) appendLog(record DeliveryAttempt) {
+	d.logLock.Lock()
+	defer d.logLock.Unlock()
+	d.deliveryLogs = append(d.deliveryLogs, record)
+	if overflow := len(d.deliveryLogs) - d.config.MaxDeliveryLogs; overflow > 0 {
+		d.deliveryLogs = d.deliveryLogs[overflow:]
+	}
+}
+
+// 获取投递记录, taskId 为空时返回全部
+func (d *Dispatcher) DeliveryLogs(taskId string) []DeliveryAttempt {
+	d.logLock.RLock()
+	defer d.logLock.RUnlock()
+	logs := make([]DeliveryAttempt, 0)
+	for _, record := range d.deliveryLogs {
+		if taskId == "" || record.TaskId == taskId {
+			logs = append(logs, record)
+		}
+	}
+	return logs
+}
+
+// 签名内容为 "timestamp.body", 接收方可以用同样的方式校验并拒绝过期请求
+func Sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s.", timestamp)))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
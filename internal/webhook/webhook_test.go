@@ -0,0 +1,79 @@
+package webhook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		payload   string
+		want      string
+	}{
+		{
+			name:      "json body",
+			secret:    "secret",
+			timestamp: "1700000000",
+			payload:   `{"task_id":"1"}`,
+			want:      "c13e376ff834058e166e5368ffd5cf123f20908ea8fdf77d4c70fb0dd5b4e60b",
+		},
+		{
+			name:      "empty body",
+			secret:    "secret",
+			timestamp: "1700000000",
+			payload:   "",
+			want:      "4bc5f74d868b97888288889c5d9d65df02526f94c1592a79fdf4fe8b26e311e5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sign(tt.secret, tt.timestamp, []byte(tt.payload)); got != tt.want {
+				t.Errorf("Sign() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestDeliverRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRetries   *int
+		statusCode   int
+		wantAttempts int32
+	}{
+		{"server error is retried", intPtr(2), http.StatusInternalServerError, 3},
+		{"too many requests is retried", intPtr(1), http.StatusTooManyRequests, 2},
+		{"client error is not retried", intPtr(3), http.StatusBadRequest, 1},
+		{"success", intPtr(3), http.StatusOK, 1},
+		{"retries disabled", intPtr(0), http.StatusInternalServerError, 1},
+		{"default retries", nil, http.StatusInternalServerError, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				w.WriteHeader(tt.statusCode)
+			}))
+			defer server.Close()
+			dispatcher := NewDispatcher(Config{MaxRetries: tt.maxRetries, InitialBackoff: time.Millisecond})
+			dispatcher.deliver(server.URL, "task", []byte("{}"))
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			if logs := dispatcher.DeliveryLogs("task"); int32(len(logs)) != tt.wantAttempts {
+				t.Errorf("delivery logs = %d, want %d", len(logs), tt.wantAttempts)
+			}
+		})
+	}
+}
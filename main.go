@@ -2,10 +2,17 @@ package main
 
 import (
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/haojie06/midjourney-http/internal/auth"
 	"github.com/haojie06/midjourney-http/internal/discordmd"
 	"github.com/haojie06/midjourney-http/internal/logger"
 	"github.com/haojie06/midjourney-http/internal/server"
+	"github.com/haojie06/midjourney-http/internal/storage"
+	"github.com/haojie06/midjourney-http/internal/webhook"
 	"github.com/spf13/viper"
 )
 
@@ -28,12 +35,62 @@ func main() {
 	if err := viper.UnmarshalKey("discordBots", &botConfigs); err != nil {
 		panic(err)
 	}
+	var serviceConfig discordmd.ServiceConfig
+	if err := viper.UnmarshalKey("service", &serviceConfig); err != nil {
+		panic(err)
+	}
+	var webhookConfig webhook.Config
+	if err := viper.UnmarshalKey("webhook", &webhookConfig); err != nil {
+		panic(err)
+	}
+	webhook.DispatcherApp = webhook.NewDispatcher(webhookConfig)
+	var storageConfig storage.Config
+	if err := viper.UnmarshalKey("storage", &storageConfig); err != nil {
+		panic(err)
+	}
+	mirror, err := storage.NewMirror(storageConfig)
+	if err != nil {
+		panic(err)
+	}
+	storage.MirrorApp = mirror
 	viper.SetDefault("server.host", "127.0.0.1")
 	viper.SetDefault("server.port", "9000")
 	host := viper.GetString("server.host")
 	port := viper.GetString("server.port")
-	apiKey := viper.GetString("server.apiKey")
+	var keyConfigs []auth.KeyConfig
+	if err := viper.UnmarshalKey("server.apiKeys", &keyConfigs); err != nil {
+		panic(err)
+	}
+	viper.SetDefault("server.keyStorePath", "data/api_keys.json")
+	viper.SetDefault("server.keyUsageStorePath", "data/api_key_usage.db")
+	keyManager, err := auth.NewKeyManager(viper.GetString("server.apiKey"), viper.GetString("server.adminKey"), keyConfigs, viper.GetString("server.keyStorePath"), viper.GetString("server.keyUsageStorePath"))
+	if err != nil {
+		panic(err)
+	}
+	auth.KeyManagerApp = keyManager
 	logger.Infof("service is starting, host: %s, port: %s", host, port)
-	go discordmd.MidJourneyServiceApp.Start(botConfigs)
-	server.Start(host, port, apiKey)
+	go func() {
+		discordmd.MidJourneyServiceApp.Start(serviceConfig, botConfigs)
+		// 修改 discordBots 后无需重启, 未变化的 bot 上的任务不受影响; 等待启动完成后再监听, 避免与启动时创建 bot 同时进行
+		viper.OnConfigChange(func(event fsnotify.Event) {
+			var botConfigs []discordmd.DiscordBotConfig
+			if err := viper.UnmarshalKey("discordBots", &botConfigs); err != nil {
+				logger.Errorf("failed to reload discordBots from %s, err: %s", event.Name, err)
+				return
+			}
+			logger.Infof("config file %s changed, reloading %d bots", event.Name, len(botConfigs))
+			discordmd.MidJourneyServiceApp.ReloadBots(botConfigs)
+		})
+		viper.WatchConfig()
+	}()
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		logger.Infof("service is shutting down")
+		discordmd.MidJourneyServiceApp.Close()
+		auth.KeyManagerApp.Close()
+		os.Exit(0)
+	}()
+	server.Start(host, port)
 }